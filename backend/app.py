@@ -43,6 +43,17 @@ bcrypt = Bcrypt(app)
 jwt = JWTManager(app)
 
 
+def cinema_location(row):
+    """Replace lon and lat of cinema row with location dict,
+    which is None if cinema coordinates are unknown.
+
+    cinemas.loc is point(lon, lat), so lon is loc[0] and lat is loc[1].
+    """
+    lon, lat = row.pop('lon'), row.pop('lat')
+    row['location'] = None if lon is None else {'lat': lat, 'lon': lon}
+    return row
+
+
 @app.route('/api/current_movies/<city_id>')
 @app.route('/api/current_movies/<city_id>/<date_str>')
 @jwt_optional
@@ -339,12 +350,13 @@ def get_movie_info(movie_id):
 @jwt_optional
 def get_cinema_info(cinema_id):
     cur = conn.cursor()
-    columns = ('name', 'address', 'location', 'city_id', 'city_name', 'is_favorite')
+    columns = ('name', 'address', 'lon', 'lat', 'city_id', 'city_name', 'is_favorite')
     cur.execute("""
     SELECT
         c.name,
         c.address,
-        c.loc,
+        c.loc[0],
+        c.loc[1],
         ct.city_id,
         ct.name,
         (ufc.cinema_id is not null) as is_favorite
@@ -357,7 +369,7 @@ def get_cinema_info(cinema_id):
         'user_id': get_jwt_identity()
     })
 
-    result = dict(zip(columns, cur.fetchone()))
+    result = cinema_location(dict(zip(columns, cur.fetchone())))
     result['cinema_id'] = int(cinema_id)
 
     cur.close()
@@ -599,7 +611,7 @@ def me():
 
     cinema_columns = (
         'cinema_id', 'name', 'address',
-        'location', 'city_id', 'city_name'
+        'lon', 'lat', 'city_id', 'city_name'
     )
     cur = conn.cursor()
     cur.execute("""
@@ -607,7 +619,8 @@ def me():
         c.cinema_id,
         c.name,
         c.address,
-        c.loc,
+        c.loc[0],
+        c.loc[1],
         ct.city_id,
         ct.name
     FROM user_favorite_cinemas ufc
@@ -617,7 +630,7 @@ def me():
     """, {
         'user_id': user_id,
     })
-    fav_cinemas = [dict(zip(cinema_columns, v)) for v in cur.fetchall()]
+    fav_cinemas = [cinema_location(dict(zip(cinema_columns, v))) for v in cur.fetchall()]
     cur.close()
 
     result = {
@@ -0,0 +1,320 @@
+// Package afishatest provides fake Yandex.Afisha server for end-to-end testing
+package afishatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stek29/kr/crawler/afisha"
+)
+
+// DefaultMaxLimit is page size limit, same as real API one
+const DefaultMaxLimit = 20
+
+// captchaPage is served instead of responses when captcha is enabled
+const captchaPage = `<!DOCTYPE html><html><body><form action="/checkcaptcha"><img src="/captcha.png"></form></body></html>`
+
+type scheduleKey struct {
+	id   string
+	date afisha.Date
+}
+
+type injectedError struct {
+	prefix string
+	status int
+	count  int
+}
+
+// Server is fake Yandex.Afisha with real pagination semantics.
+// Use Add* methods to fill it with data before pointing afisha.BaseURL at URL.
+type Server struct {
+	*httptest.Server
+
+	// MaxLimit is maximal page size, DefaultMaxLimit if zero
+	MaxLimit int
+
+	mu               sync.Mutex
+	cities           []afisha.City
+	places           map[string][]afisha.Place
+	repertories      map[string][]afisha.RepertoryItem
+	placeRepertories map[string][]afisha.RepertoryItem
+	schedules        map[scheduleKey][]afisha.ScheduleItem
+	events           map[string]afisha.EventDetails
+	pages            map[string]string
+	errors           []*injectedError
+	delay            time.Duration
+	captcha          bool
+	requests         []string
+}
+
+// NewServer starts new empty fake server
+func NewServer() *Server {
+	s := &Server{
+		places:           map[string][]afisha.Place{},
+		repertories:      map[string][]afisha.RepertoryItem{},
+		placeRepertories: map[string][]afisha.RepertoryItem{},
+		schedules:        map[scheduleKey][]afisha.ScheduleItem{},
+		events:           map[string]afisha.EventDetails{},
+		pages:            map[string]string{},
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// BaseURL is value for afisha.BaseURL
+func (s *Server) BaseURL() string {
+	return s.URL + "/"
+}
+
+// AddCity adds city to cities list
+func (s *Server) AddCity(city afisha.City) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cities = append(s.cities, city)
+}
+
+// AddPlace adds place to its city
+func (s *Server) AddPlace(pl afisha.Place) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.places[pl.City.ID] = append(s.places[pl.City.ID], pl)
+}
+
+// AddRepertoryItem adds item to city repertory
+func (s *Server) AddRepertoryItem(city string, item afisha.RepertoryItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repertories[city] = append(s.repertories[city], item)
+}
+
+// AddPlaceRepertoryItem adds item to place repertory
+func (s *Server) AddPlaceRepertoryItem(placeID string, item afisha.RepertoryItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.placeRepertories[placeID] = append(s.placeRepertories[placeID], item)
+}
+
+// AddScheduleItem adds item to schedules of its place and event for its date
+func (s *Server) AddScheduleItem(item afisha.ScheduleItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item.Place != nil {
+		key := scheduleKey{item.Place.ID, item.Date}
+		s.schedules[key] = append(s.schedules[key], item)
+	}
+	if item.Event != nil {
+		key := scheduleKey{item.Event.ID, item.Date}
+		s.schedules[key] = append(s.schedules[key], item)
+	}
+}
+
+// AddEvent adds event details and event page with given HTML at event URL
+func (s *Server) AddEvent(ev afisha.EventDetails, page string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events[ev.ID] = ev
+	if ev.URL != "" {
+		s.pages[path.Clean("/"+ev.URL)] = page
+	}
+}
+
+// FailRequests makes next count requests with path starting with prefix fail with status.
+// Negative count means forever.
+func (s *Server) FailRequests(prefix string, status, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, &injectedError{prefix, status, count})
+}
+
+// SetDelay makes server respond slowly
+func (s *Server) SetDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+}
+
+// SetCaptcha makes server respond with captcha page to every request
+func (s *Server) SetCaptcha(captcha bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captcha = captcha
+}
+
+// Requests returns URLs of all requests received so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// injectedStatus returns status of injected error for path, if any
+func (s *Server) injectedStatus(p string) int {
+	for _, e := range s.errors {
+		if e.count != 0 && strings.HasPrefix(p, e.prefix) {
+			if e.count > 0 {
+				e.count--
+			}
+			return e.status
+		}
+	}
+	return 0
+}
+
+// ServeHTTP conforms to http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.String())
+	delay, captcha := s.delay, s.captcha
+	p := path.Clean(r.URL.Path)
+	status := s.injectedStatus(p)
+	s.mu.Unlock()
+
+	if delay != 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if captcha {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(captchaPage))
+		return
+	}
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if !strings.HasPrefix(p, "/api/") {
+		s.servePage(w, p)
+		return
+	}
+
+	s.serveAPI(w, r, strings.Split(strings.TrimPrefix(p, "/api/"), "/"))
+}
+
+func (s *Server) servePage(w http.ResponseWriter, p string) {
+	s.mu.Lock()
+	page, ok := s.pages[p]
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(page))
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(parts) == 1 && parts[0] == "cities":
+		writeJSON(w, struct {
+			Data []afisha.City `json:"data"`
+		}{s.cities})
+
+	case len(parts) == 3 && parts[0] == "events" && parts[1] == "cinema" && parts[2] == "places":
+		items := s.places[q.Get("city")]
+		paging, lo, hi := s.page(q, len(items))
+		writeJSON(w, afisha.Places{Items: items[lo:hi], Paging: paging})
+
+	case len(parts) == 3 && parts[0] == "events" && parts[1] == "selection" && parts[2] == "all-events-cinema":
+		items := s.repertories[q.Get("city")]
+		paging, lo, hi := s.page(q, len(items))
+		writeJSON(w, afisha.Repertory{Data: items[lo:hi], Paging: paging})
+
+	case len(parts) == 3 && parts[0] == "places" && parts[2] == "repertory":
+		items := s.placeRepertories[parts[1]]
+		paging, lo, hi := s.page(q, len(items))
+		writeJSON(w, afisha.Repertory{Data: items[lo:hi], Paging: paging})
+
+	case len(parts) == 3 && (parts[0] == "places" || parts[0] == "events") && parts[2] == "schedule_cinema":
+		date, err := afisha.ParseDate(q.Get("date"))
+		if err != nil {
+			http.Error(w, "Invalid date", http.StatusBadRequest)
+			return
+		}
+
+		items := s.schedules[scheduleKey{parts[1], date}]
+		paging, lo, hi := s.page(q, len(items))
+
+		var resp struct {
+			Schedule afisha.ScheduleCinema `json:"schedule"`
+		}
+		resp.Schedule.Params.Date = date
+		resp.Schedule.Paging = paging
+		resp.Schedule.Items = items[lo:hi]
+		writeJSON(w, resp)
+
+	case len(parts) == 2 && parts[0] == "events":
+		ev, ok := s.events[parts[1]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, struct {
+			Data afisha.EventDetails `json:"data"`
+		}{ev})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// page applies limit and offset query params to total items
+func (s *Server) page(q map[string][]string, total int) (paging afisha.PagingData, lo, hi int) {
+	maxLimit := s.MaxLimit
+	if maxLimit == 0 {
+		maxLimit = DefaultMaxLimit
+	}
+
+	get := func(key string) int {
+		if v := q[key]; len(v) != 0 {
+			n, _ := strconv.Atoi(v[0])
+			return n
+		}
+		return 0
+	}
+
+	limit := get("limit")
+	if limit <= 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+
+	offset := get("offset")
+	if offset < 0 {
+		offset = 0
+	}
+
+	lo, hi = offset, offset+limit
+	if lo > total {
+		lo = total
+	}
+	if hi > total {
+		hi = total
+	}
+
+	return afisha.PagingData{Limit: limit, Offset: offset, Total: total}, lo, hi
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
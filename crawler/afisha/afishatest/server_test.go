@@ -0,0 +1,204 @@
+package afishatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stek29/kr/crawler/afisha"
+)
+
+// withServer points afisha.BaseURL to new server until returned func is called
+func withServer() (*Server, func()) {
+	s := NewServer()
+	prev := afisha.BaseURL
+	afisha.BaseURL = s.BaseURL()
+
+	return s, func() {
+		afisha.BaseURL = prev
+		s.Close()
+	}
+}
+
+func testPlace(i int) afisha.Place {
+	return afisha.Place{
+		ID:    fmt.Sprintf("5575f2a9cc1c725c1f8c6c%02d", i),
+		Title: fmt.Sprintf("Кинотеатр %d", i),
+		City:  afisha.City{ID: "moscow", Name: "Москва", TimeZone: "Europe/Moscow"},
+	}
+}
+
+func TestPaging(t *testing.T) {
+	s, done := withServer()
+	defer done()
+	s.MaxLimit = 2
+
+	for i := 0; i < 5; i++ {
+		s.AddPlace(testPlace(i))
+	}
+
+	places, err := afisha.GetPlacesFull(http.DefaultClient, &afisha.PlacesParams{City: "moscow", Limit: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(places.Items) != 5 {
+		t.Fatalf("Expected 5 places, got %d", len(places.Items))
+	}
+	for i, pl := range places.Items {
+		if pl.ID != testPlace(i).ID {
+			t.Errorf("Place #%d is %v, want %v", i, pl.ID, testPlace(i).ID)
+		}
+	}
+
+	if n := len(s.Requests()); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+}
+
+func TestPlaceItemsEarlyStop(t *testing.T) {
+	s, done := withServer()
+	defer done()
+	s.MaxLimit = 2
+
+	for i := 0; i < 10; i++ {
+		s.AddPlace(testPlace(i))
+	}
+
+	it := afisha.PlaceItems(context.Background(), http.DefaultClient, &afisha.PlacesParams{City: "moscow", Limit: 2})
+	for i := 0; i < 3; i++ {
+		if !it.Next() {
+			t.Fatalf("Expected place #%d, got error %v", i, it.Err())
+		}
+		if it.Item().ID != testPlace(i).ID {
+			t.Errorf("Place #%d is %v, want %v", i, it.Item().ID, testPlace(i).ID)
+		}
+	}
+	it.Close()
+
+	if err := it.Err(); err != nil {
+		t.Errorf("Expected no error after Close, got %v", err)
+	}
+	// Third page might be requested while second one is consumed
+	if n := len(s.Requests()); n > 3 {
+		t.Errorf("Expected at most 3 requests, got %d", n)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, done := withServer()
+	defer done()
+
+	pl := testPlace(1)
+	ev := afisha.Event{ID: "5c6f0e9a1e2fdb0d1f3c2b01", Title: "Аладдин"}
+	date := afisha.MakeDate(2019, 6, 1)
+
+	s.AddScheduleItem(afisha.ScheduleItem{Date: date, Place: &pl, Event: &ev})
+
+	for _, params := range []afisha.ScheduleCinemaParams{
+		{PlaceID: pl.ID, Date: date},
+		{EventID: ev.ID, Date: date},
+	} {
+		schd, err := afisha.GetScheduleCinemaFull(http.DefaultClient, &params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(schd.Items) != 1 || schd.Params.Date != date {
+			t.Errorf("Unexpected schedule for %+v: %+v", params, schd)
+		}
+	}
+
+	schd, err := afisha.GetScheduleCinemaFull(http.DefaultClient, &afisha.ScheduleCinemaParams{PlaceID: pl.ID, Date: afisha.MakeDate(2019, 6, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schd.Items) != 0 {
+		t.Errorf("Expected empty schedule for other date")
+	}
+}
+
+func TestFailRequests(t *testing.T) {
+	s, done := withServer()
+	defer done()
+	s.AddPlace(testPlace(1))
+	s.FailRequests("/api/events/cinema/places", http.StatusInternalServerError, 1)
+
+	params := afisha.PlacesParams{City: "moscow"}
+	_, err := afisha.GetPlaces(http.DefaultClient, &params)
+	var statusErr *afisha.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected injected status error, got %v", err)
+	}
+	if _, err := afisha.GetPlaces(http.DefaultClient, &params); err != nil {
+		t.Errorf("Expected only one request to fail, got %v", err)
+	}
+}
+
+func TestCaptcha(t *testing.T) {
+	s, done := withServer()
+	defer done()
+	s.AddPlace(testPlace(1))
+	s.SetCaptcha(true)
+
+	if _, err := afisha.GetPlaces(http.DefaultClient, &afisha.PlacesParams{City: "moscow"}); err == nil {
+		t.Errorf("Expected error on captcha page")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	s, done := withServer()
+	defer done()
+	s.SetDelay(time.Second)
+
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	if _, err := afisha.GetPlaces(client, &afisha.PlacesParams{City: "moscow"}); err == nil {
+		t.Errorf("Expected timeout")
+	}
+}
+
+func TestEvent(t *testing.T) {
+	s, done := withServer()
+	defer done()
+
+	ev := afisha.EventDetails{
+		Event:    afisha.Event{ID: "5c6f0e9a1e2fdb0d1f3c2b01", URL: "/moscow/cinema/aladdin", Title: "Аладдин"},
+		Duration: 128,
+	}
+	s.AddEvent(ev, "<html></html>")
+
+	got, err := afisha.GetEvent(context.Background(), http.DefaultClient, ev.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != ev.Title || got.Duration != ev.Duration {
+		t.Errorf("Unexpected event: %+v", got)
+	}
+
+	resp, err := http.Get(afisha.BaseURL + ev.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Event page status is %d", resp.StatusCode)
+	}
+}
+
+func TestCities(t *testing.T) {
+	s, done := withServer()
+	defer done()
+
+	city := afisha.City{ID: "moscow", Name: "Москва", GeoID: 213, TimeZone: "Europe/Moscow"}
+	s.AddCity(city)
+
+	cities, err := afisha.GetCities(context.Background(), http.DefaultClient, &afisha.CitiesParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cities) != 1 || cities[0] != city {
+		t.Errorf("Unexpected cities: %+v", cities)
+	}
+}
@@ -1,8 +1,10 @@
 package afisha
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"sync"
 )
 
 // ScheduleCinemaParams holds params for GetScheduleCinema call
@@ -13,6 +15,9 @@ type ScheduleCinemaParams struct {
 	City    string `url:"city,omitempty"`
 	Limit   int    `url:"limit,omitempty"`
 	Offset  int    `url:"offset,omitempty"`
+
+	// Paging is used by GetScheduleCinemaFull and ScheduleItems
+	Paging PagingOptions `url:"-"`
 }
 
 type scheduleCinemaResponse struct {
@@ -30,6 +35,10 @@ type ScheduleCinema struct {
 
 // GetScheduleCinema gets cinema schedule (either for cinema or event)
 func GetScheduleCinema(client *http.Client, params *ScheduleCinemaParams) (*ScheduleCinema, error) {
+	return getScheduleCinema(context.Background(), client, params)
+}
+
+func getScheduleCinema(ctx context.Context, client *http.Client, params *ScheduleCinemaParams) (*ScheduleCinema, error) {
 	var endpoint string
 
 	switch {
@@ -44,37 +53,72 @@ func GetScheduleCinema(client *http.Client, params *ScheduleCinemaParams) (*Sche
 	}
 
 	var resp scheduleCinemaResponse
-	err := request(client, endpoint, params, &resp)
+	err := request(ctx, client, endpoint, params, &resp)
 	if err != nil {
 		return nil, err
 	}
 	return &resp.Schedule, nil
 }
 
-// GetScheduleCinemaFull is GetScheduleCinema which loads all results
-func GetScheduleCinemaFull(client *http.Client, params *ScheduleCinemaParams) (*ScheduleCinema, error) {
-	var result ScheduleCinema
-	pagedParams := *params
+// ScheduleItemKey identifies ScheduleItem for deduplication
+func ScheduleItemKey(item *ScheduleItem) string {
+	var placeID, eventID string
+	if item.Place != nil {
+		placeID = item.Place.ID
+	}
+	if item.Event != nil {
+		eventID = item.Event.ID
+	}
+	return placeID + ";" + eventID + ";" + item.Date.String()
+}
 
-	err := PagingLoad(params.Offset, params.Limit, func(offset int, limit int) (*PagingData, int, error) {
-		pagedParams.Offset = offset
-		pagedParams.Limit = limit
+// schedulePager is Pager of cinema schedule, it keeps date reported by API
+type schedulePager struct {
+	client *http.Client
+	params ScheduleCinemaParams
 
-		page, err := GetScheduleCinema(client, &pagedParams)
-		if err != nil {
-			return nil, 0, err
-		}
+	mu   sync.Mutex
+	date Date
+}
 
-		result.Params.Date = page.Params.Date
-		result.Items = append(result.Items, page.Items...)
+func (p *schedulePager) Page(ctx context.Context, offset, limit int) ([]ScheduleItem, *PagingData, error) {
+	params := p.params
+	params.Offset = offset
+	params.Limit = limit
 
-		return &page.Paging, len(page.Items), nil
-	})
+	page, err := getScheduleCinema(ctx, p.client, &params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	p.date = page.Params.Date
+	p.mu.Unlock()
 
+	return page.Items, &page.Paging, nil
+}
+
+func (p *schedulePager) Key(item *ScheduleItem) string {
+	return ScheduleItemKey(item)
+}
+
+// ScheduleItems starts loading cinema schedule in background
+func ScheduleItems(ctx context.Context, client *http.Client, params *ScheduleCinemaParams) *Iterator[ScheduleItem] {
+	pager := &schedulePager{client: client, params: *params}
+	return Items[ScheduleItem](ctx, pager, params.Offset, params.Limit, params.Paging)
+}
+
+// GetScheduleCinemaFull is GetScheduleCinema which loads all results
+func GetScheduleCinemaFull(client *http.Client, params *ScheduleCinemaParams) (*ScheduleCinema, error) {
+	pager := &schedulePager{client: client, params: *params}
+	items, err := FetchAll[ScheduleItem](context.Background(), pager, params.Offset, params.Limit, params.Paging)
 	if err != nil {
 		return nil, err
 	}
 
+	var result ScheduleCinema
+	result.Params.Date = pager.date
+	result.Items = items
 	return &result, nil
 }
 
@@ -85,6 +129,9 @@ type RepertoryParams struct {
 	City    string `url:"city"`
 	Limit   int    `url:"limit,omitempty"`
 	Offset  int    `url:"offset,omitempty"`
+
+	// Paging is used by GetRepetoryFull and RepertoryItems
+	Paging PagingOptions `url:"-"`
 }
 
 // Repertory is result of GetRepetory call
@@ -95,6 +142,10 @@ type Repertory struct {
 
 // GetRepetory gets reportory of all cinema events in city, or repertory for exact place
 func GetRepetory(client *http.Client, params *RepertoryParams) (*Repertory, error) {
+	return getRepetory(context.Background(), client, params)
+}
+
+func getRepetory(ctx context.Context, client *http.Client, params *RepertoryParams) (*Repertory, error) {
 	var endpoint string
 
 	if params.PlaceID == "" {
@@ -104,37 +155,43 @@ func GetRepetory(client *http.Client, params *RepertoryParams) (*Repertory, erro
 	}
 
 	var resp Repertory
-	err := request(client, endpoint, params, &resp)
+	err := request(ctx, client, endpoint, params, &resp)
 	if err != nil {
 		return nil, err
 	}
 	return &resp, nil
 }
 
-// GetRepetoryFull is GetRepetory which loads all results
-func GetRepetoryFull(client *http.Client, params *RepertoryParams) (*Repertory, error) {
-	var result Repertory
-	pagedParams := *params
-
-	err := PagingLoad(params.Offset, params.Limit, func(offset int, limit int) (*PagingData, int, error) {
+// RepertoryPager makes Pager of repertory
+func RepertoryPager(client *http.Client, params *RepertoryParams) Pager[RepertoryItem] {
+	base := *params
+	return NewPager(func(ctx context.Context, offset, limit int) ([]RepertoryItem, *PagingData, error) {
+		pagedParams := base
 		pagedParams.Offset = offset
 		pagedParams.Limit = limit
 
-		page, err := GetRepetory(client, &pagedParams)
+		page, err := getRepetory(ctx, client, &pagedParams)
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, err
 		}
-
-		result.Data = append(result.Data, page.Data...)
-
-		return &page.Paging, len(page.Data), nil
+		return page.Data, &page.Paging, nil
+	}, func(item *RepertoryItem) string {
+		return item.Event.ID
 	})
+}
 
+// RepertoryItems starts loading repertory in background
+func RepertoryItems(ctx context.Context, client *http.Client, params *RepertoryParams) *Iterator[RepertoryItem] {
+	return Items(ctx, RepertoryPager(client, params), params.Offset, params.Limit, params.Paging)
+}
+
+// GetRepetoryFull is GetRepetory which loads all results
+func GetRepetoryFull(client *http.Client, params *RepertoryParams) (*Repertory, error) {
+	items, err := FetchAll(context.Background(), RepertoryPager(client, params), params.Offset, params.Limit, params.Paging)
 	if err != nil {
 		return nil, err
 	}
-
-	return &result, nil
+	return &Repertory{Data: items}, nil
 }
 
 // PlacesParams holds params for GetPlaces call
@@ -142,6 +199,9 @@ type PlacesParams struct {
 	City   string `url:"city"`
 	Limit  int    `url:"limit,omitempty"`
 	Offset int    `url:"offset,omitempty"`
+
+	// Paging is used by GetPlacesFull and PlaceItems
+	Paging PagingOptions `url:"-"`
 }
 
 // Places is result of GetPlaces call
@@ -152,37 +212,85 @@ type Places struct {
 
 // GetPlaces gets list of cinemas in city
 func GetPlaces(client *http.Client, params *PlacesParams) (*Places, error) {
+	return getPlaces(context.Background(), client, params)
+}
+
+func getPlaces(ctx context.Context, client *http.Client, params *PlacesParams) (*Places, error) {
 	endpoint := "/events/cinema/places"
 	var resp Places
-	err := request(client, endpoint, params, &resp)
+	err := request(ctx, client, endpoint, params, &resp)
 	if err != nil {
 		return nil, err
 	}
 	return &resp, nil
 }
 
-// GetPlacesFull is GetPlaces which loads all results
-func GetPlacesFull(client *http.Client, params *PlacesParams) (*Places, error) {
-	var result Places
-	pagedParams := *params
-
-	err := PagingLoad(params.Offset, params.Limit, func(offset int, limit int) (*PagingData, int, error) {
+// PlacesPager makes Pager of places
+func PlacesPager(client *http.Client, params *PlacesParams) Pager[Place] {
+	base := *params
+	return NewPager(func(ctx context.Context, offset, limit int) ([]Place, *PagingData, error) {
+		pagedParams := base
 		pagedParams.Offset = offset
 		pagedParams.Limit = limit
 
-		page, err := GetPlaces(client, &pagedParams)
+		page, err := getPlaces(ctx, client, &pagedParams)
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, err
 		}
+		return page.Items, &page.Paging, nil
+	}, func(item *Place) string {
+		return item.ID
+	})
+}
 
-		result.Items = append(result.Items, page.Items...)
+// PlaceItems starts loading places in background
+func PlaceItems(ctx context.Context, client *http.Client, params *PlacesParams) *Iterator[Place] {
+	return Items(ctx, PlacesPager(client, params), params.Offset, params.Limit, params.Paging)
+}
 
-		return &page.Paging, len(page.Items), nil
-	})
+// GetPlacesFull is GetPlaces which loads all results
+func GetPlacesFull(client *http.Client, params *PlacesParams) (*Places, error) {
+	items, err := FetchAll(context.Background(), PlacesPager(client, params), params.Offset, params.Limit, params.Paging)
+	if err != nil {
+		return nil, err
+	}
+	return &Places{Items: items}, nil
+}
 
+type eventResponse struct {
+	Data EventDetails `json:"data"`
+}
+
+// GetEvent gets full event details
+func GetEvent(ctx context.Context, client *http.Client, id string) (*EventDetails, error) {
+	if id == "" {
+		return nil, errors.New("Event ID is required")
+	}
+
+	var resp eventResponse
+	err := request(ctx, client, "events/"+id, struct{}{}, &resp)
 	if err != nil {
 		return nil, err
 	}
+	return &resp.Data, nil
+}
 
-	return &result, nil
+// CitiesParams holds params for GetCities call
+type CitiesParams struct {
+	// Preferred language of city names, like ru
+	Lang string `url:"lang,omitempty"`
+}
+
+type citiesResponse struct {
+	Data []City `json:"data"`
+}
+
+// GetCities gets list of all cities supported by Afisha
+func GetCities(ctx context.Context, client *http.Client, params *CitiesParams) ([]City, error) {
+	var resp citiesResponse
+	err := request(ctx, client, "cities", params, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
 }
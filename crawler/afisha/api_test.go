@@ -0,0 +1,128 @@
+package afisha
+
+import (
+	"flag"
+	"net/http"
+	"testing"
+
+	"github.com/stek29/kr/crawler/afisha/replay"
+)
+
+var record = flag.Bool("record", false, "Record fixtures from real API instead of replaying them")
+
+// fixtureClient replays fixtures from testdata/fixtures.
+// Checked in fixtures are synthetic, see testdata/README.md.
+func fixtureClient() *http.Client {
+	tr := &replay.Transport{Dir: "testdata/fixtures"}
+	if *record {
+		tr.Mode = replay.Record
+	}
+	return tr.Client()
+}
+
+func TestGetPlacesFull(t *testing.T) {
+	places, err := GetPlacesFull(fixtureClient(), &PlacesParams{
+		City:  "moscow",
+		Limit: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(places.Items) != 3 {
+		t.Fatalf("Expected 3 places, got %d", len(places.Items))
+	}
+
+	pl := places.Items[0]
+	if pl.ID != "5575f2a9cc1c725c1f8c6c01" || pl.Title != "Синема Парк Мега" {
+		t.Errorf("Unexpected first place: %v %v", pl.ID, pl.Title)
+	}
+	if pl.City.ID != "moscow" || pl.City.TimeZone != "Europe/Moscow" || pl.City.GeoID != 213 {
+		t.Errorf("Unexpected place city: %+v", pl.City)
+	}
+	if !pl.Coordinates.Valid() || pl.Coordinates.Latitude != 55.75 {
+		t.Errorf("Unexpected place coordinates: %+v", pl.Coordinates)
+	}
+	if len(pl.Metro) != 1 || pl.Metro[0].Name != "Охотный Ряд" {
+		t.Errorf("Unexpected place metro: %+v", pl.Metro)
+	}
+	if pl.LogoColor.String() != "#ff0000" || pl.LogoColor.IsZero() {
+		t.Errorf("Unexpected logo color: %v", pl.LogoColor)
+	}
+	if places.Items[2].ID != "5575f2a9cc1c725c1f8c6c03" {
+		t.Errorf("Unexpected last place: %v", places.Items[2].ID)
+	}
+}
+
+func TestGetRepetoryFull(t *testing.T) {
+	rep, err := GetRepetoryFull(fixtureClient(), &RepertoryParams{
+		City:  "moscow",
+		Limit: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rep.Data) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(rep.Data))
+	}
+
+	item := rep.Data[1]
+	if item.Event.Title != "Годзилла 2" || item.Event.Kinopoisk.Value != 7.5 {
+		t.Errorf("Unexpected event: %+v", item.Event)
+	}
+	if len(item.ScheduleInfo.Dates) != 2 || item.ScheduleInfo.Dates[0] != MakeDate(2019, 6, 1) {
+		t.Errorf("Unexpected schedule dates: %v", item.ScheduleInfo.Dates)
+	}
+	if item.ScheduleInfo.DateReleased != MakeDate(2019, 5, 30) {
+		t.Errorf("Unexpected release date: %v", item.ScheduleInfo.DateReleased)
+	}
+}
+
+func TestGetScheduleCinemaFull(t *testing.T) {
+	schd, err := GetScheduleCinemaFull(fixtureClient(), &ScheduleCinemaParams{
+		PlaceID: "5575f2a9cc1c725c1f8c6c01",
+		City:    "moscow",
+		Date:    MakeDate(2019, 6, 1),
+		Limit:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if schd.Params.Date != MakeDate(2019, 6, 1) {
+		t.Errorf("Unexpected schedule date: %v", schd.Params.Date)
+	}
+	if len(schd.Items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(schd.Items))
+	}
+
+	item := schd.Items[0]
+	if item.Event == nil || item.Event.Title != "Аладдин" || item.Place == nil {
+		t.Fatalf("Unexpected item: %+v", item)
+	}
+	if len(item.Schedule) != 2 {
+		t.Fatalf("Expected 2 formats, got %d", len(item.Schedule))
+	}
+
+	imax := item.Schedule[1]
+	if imax.Format != "IMAX 3D" || len(imax.Tags) != 1 || imax.Tags[0] != "Детям" {
+		t.Errorf("Unexpected format or tags: %v %v", imax.Format, imax.Tags)
+	}
+
+	sess := imax.Sessions[0]
+	if sess.Datetime != "2019-06-01T19:00:00" || sess.HallName != "IMAX" || sess.Ticket.Price.Min != 50000 {
+		t.Errorf("Unexpected session: %+v", sess)
+	}
+}
+
+func TestGetScheduleCinemaParams(t *testing.T) {
+	client := fixtureClient()
+
+	if _, err := GetScheduleCinema(client, &ScheduleCinemaParams{}); err == nil {
+		t.Errorf("Expected error without EventID and PlaceID")
+	}
+	if _, err := GetScheduleCinema(client, &ScheduleCinemaParams{EventID: "a", PlaceID: "b"}); err == nil {
+		t.Errorf("Expected error with both EventID and PlaceID")
+	}
+}
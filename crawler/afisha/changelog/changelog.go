@@ -0,0 +1,454 @@
+// Package changelog tracks crawl outputs between runs.
+//
+// Every crawl output file is a unit, which is a JSON list of items with IDs.
+// Store hashes units and their items, skips writing units which didn't change,
+// and records new, removed and changed items in change log, so fill can only
+// apply deltas. Units crawl no longer produces are removed with Sweep,
+// which records all their items as removed.
+//
+// Change log accumulates changes of all runs until fill acknowledges units
+// it applied with Acknowledge. Acknowledgements are kept in separate file
+// only written by fill, and crawl drops acknowledged units from change log.
+package changelog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha/util"
+)
+
+const (
+	// ManifestFile keeps unit hashes between runs
+	ManifestFile = "manifest.json"
+	// ChangesFile is change log of runs whose units weren't acknowledged yet
+	ChangesFile = "changes.json"
+	// AckFile keeps units acknowledged by fill
+	AckFile = "changes.ack.json"
+)
+
+// Op is kind of item change
+type Op string
+
+// Item changes
+const (
+	OpNew     Op = "new"
+	OpRemoved Op = "removed"
+	OpChanged Op = "changed"
+)
+
+// Change is a change of single item in unit
+type Change struct {
+	// Kind is item kind, like place, event or session
+	Kind string `json:"kind"`
+	// Unit is path of unit relative to output dir
+	Unit string `json:"unit"`
+	ID   string `json:"id"`
+	Op   Op     `json:"op"`
+	// Time is start time of the run which recorded the change
+	Time time.Time `json:"time"`
+}
+
+// Log is change log of crawl runs since fill acknowledged their units
+type Log struct {
+	// Time is start time of the last run
+	Time time.Time `json:"time"`
+	// Units map paths of written or removed units relative to output dir
+	// to start time of the last run which wrote or removed them
+	Units   map[string]time.Time `json:"units"`
+	Changes []Change             `json:"changes"`
+}
+
+// Load loads change log saved in dir, without units acknowledged by fill
+func Load(dir string) (*Log, error) {
+	l, err := loadLog(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ack, err := LoadAck(dir)
+	if err != nil {
+		return nil, err
+	}
+	l.prune(ack)
+
+	return l, nil
+}
+
+// loadLog loads change log saved in dir as is, with acknowledged units
+func loadLog(dir string) (*Log, error) {
+	var l Log
+	if err := util.UnmarshalFromFile(filepath.Join(dir, ChangesFile), &l); err != nil {
+		return nil, err
+	}
+	if l.Units == nil {
+		l.Units = map[string]time.Time{}
+	}
+	return &l, nil
+}
+
+// prune drops units and changes acknowledged by ack
+func (l *Log) prune(ack Ack) {
+	for unit, t := range l.Units {
+		if !t.After(ack[unit]) {
+			delete(l.Units, unit)
+		}
+	}
+
+	changes := l.Changes[:0]
+	for _, c := range l.Changes {
+		if c.Time.After(ack[c.Unit]) {
+			changes = append(changes, c)
+		}
+	}
+	l.Changes = changes
+}
+
+// UnitChanged checks if unit at path relative to output dir was written since fill acknowledged it
+func (l *Log) UnitChanged(unit string) bool {
+	_, ok := l.Units[filepath.ToSlash(unit)]
+	return ok
+}
+
+// Count returns number of changes with kind and op
+func (l *Log) Count(kind string, op Op) int {
+	n := 0
+	for _, c := range l.Changes {
+		if c.Kind == kind && c.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// Removed returns removed items of kind in units under dir relative to output dir
+func (l *Log) Removed(kind, dir string) []Change {
+	prefix := strings.TrimSuffix(filepath.ToSlash(dir), "/") + "/"
+
+	var res []Change
+	for _, c := range l.Changes {
+		if c.Kind == kind && c.Op == OpRemoved && strings.HasPrefix(c.Unit, prefix) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Ack maps units to start time of the last run whose write of unit was applied by fill
+type Ack map[string]time.Time
+
+// LoadAck loads acknowledgements saved in dir, missing file means nothing was acknowledged
+func LoadAck(dir string) (Ack, error) {
+	ack := Ack{}
+	err := util.UnmarshalFromFile(filepath.Join(dir, AckFile), &ack)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Failed to load change log acknowledgements")
+	}
+	return ack, nil
+}
+
+// Acknowledge records that units of l at paths relative to output dir were applied,
+// so they are dropped from change log unless written again.
+// Only fill should acknowledge units.
+func Acknowledge(dir string, l *Log, units []string) error {
+	ack, err := LoadAck(dir)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := LoadManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to load manifest")
+	}
+	saved, err := loadLog(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Failed to load change log")
+	}
+
+	// Acknowledgements are only dropped for units crawl forgot, which are neither in manifest
+	// nor in saved change log. Units missing in l were acknowledged before and must stay so.
+	for unit := range ack {
+		_, inManifest := manifest[unit]
+		inLog := false
+		if saved != nil {
+			_, inLog = saved.Units[unit]
+		}
+		if !inManifest && !inLog {
+			delete(ack, unit)
+		}
+	}
+
+	for _, unit := range units {
+		unit = filepath.ToSlash(unit)
+		if t, ok := l.Units[unit]; ok && t.After(ack[unit]) {
+			ack[unit] = t
+		}
+	}
+
+	return writeFile(filepath.Join(dir, AckFile), ack)
+}
+
+// writeFile writes v as JSON into fn through temporary file,
+// so fn is never left partially written
+func writeFile(fn string, v interface{}) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
+
+// unitState is unit hash and hashes of its items by ID
+type unitState struct {
+	Hash  string            `json:"hash"`
+	Items map[string]string `json:"items"`
+	// Crawled is start time of the last run which crawled the unit, even if it didn't change
+	Crawled time.Time `json:"crawled"`
+}
+
+// Manifest is state of units saved by previous runs
+type Manifest map[string]unitState
+
+// LoadManifest loads manifest saved in dir
+func LoadManifest(dir string) (Manifest, error) {
+	m := Manifest{}
+	if err := util.UnmarshalFromFile(filepath.Join(dir, ManifestFile), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Crawled returns time unit at path relative to output dir was last crawled.
+// It returns false for units crawled before crawl times were recorded.
+func (m Manifest) Crawled(unit string) (time.Time, bool) {
+	state, ok := m[filepath.ToSlash(unit)]
+	if !ok || state.Crawled.IsZero() {
+		return time.Time{}, false
+	}
+	return state.Crawled, true
+}
+
+// Store writes units into output dir, see package doc
+type Store struct {
+	dir string
+
+	mu       sync.Mutex
+	manifest Manifest
+	log      Log
+}
+
+// Open opens store in output dir, loading manifest of previous run if any,
+// and change log of runs which weren't acknowledged by fill yet
+func Open(dir string) (*Store, error) {
+	s := &Store{
+		dir:      dir,
+		manifest: Manifest{},
+		log:      Log{Units: map[string]time.Time{}, Changes: []Change{}},
+	}
+
+	err := util.UnmarshalFromFile(filepath.Join(dir, ManifestFile), &s.manifest)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Failed to load manifest")
+	}
+
+	l, err := Load(dir)
+	switch {
+	case err == nil:
+		s.log = *l
+	case !os.IsNotExist(err):
+		return nil, errors.Wrap(err, "Failed to load change log")
+	}
+	s.log.Time = time.Now().UTC()
+
+	return s, nil
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Save writes items into unit at path relative to output dir, unless it didn't change.
+// key identifies items of kind, it's used to record item changes.
+// It returns true if unit was written.
+func Save[T any](s *Store, unit, kind string, items []T, key func(item *T) string) (bool, error) {
+	unit = filepath.ToSlash(unit)
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return false, err
+	}
+	data = append(data, '\n')
+
+	state := unitState{
+		Hash:    hash(data),
+		Items:   make(map[string]string, len(items)),
+		Crawled: s.log.Time,
+	}
+	for i := range items {
+		itemData, err := json.Marshal(&items[i])
+		if err != nil {
+			return false, err
+		}
+		state.Items[key(&items[i])] = hash(itemData)
+	}
+
+	fn := filepath.Join(s.dir, filepath.FromSlash(unit))
+
+	s.mu.Lock()
+	prev, known := s.manifest[unit]
+	s.mu.Unlock()
+
+	if known && prev.Hash == state.Hash {
+		if _, err := os.Stat(fn); err == nil {
+			s.mu.Lock()
+			s.manifest[unit] = state
+			s.mu.Unlock()
+			return false, nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		os.Remove(fn)
+		return false, err
+	}
+
+	var changes []Change
+	changed := map[string]struct{}{}
+	for id, h := range state.Items {
+		prevHash, ok := prev.Items[id]
+		switch {
+		case !ok:
+			changes = append(changes, Change{kind, unit, id, OpNew, s.log.Time})
+		case prevHash != h:
+			changes = append(changes, Change{kind, unit, id, OpChanged, s.log.Time})
+		default:
+			continue
+		}
+		changed[id] = struct{}{}
+	}
+	for id := range prev.Items {
+		if _, ok := state.Items[id]; !ok {
+			changes = append(changes, Change{kind, unit, id, OpRemoved, s.log.Time})
+			changed[id] = struct{}{}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].ID < changes[j].ID
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifest[unit] = state
+	s.record(unit, changed, changes)
+
+	return true, nil
+}
+
+// record adds changes of items of unit to change log, s.mu must be held.
+// Only the last change of item is kept, so log of unacknowledged runs doesn't grow with every run.
+func (s *Store) record(unit string, changed map[string]struct{}, changes []Change) {
+	s.log.Units[unit] = s.log.Time
+
+	kept := s.log.Changes[:0]
+	for _, c := range s.log.Changes {
+		if _, ok := changed[c.ID]; ok && c.Unit == unit {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	s.log.Changes = append(kept, changes...)
+}
+
+// Sweep removes units of kind under dir relative to output dir which weren't saved by this run,
+// recording all their items as removed. It must only be called once everything under dir
+// was crawled successfully, otherwise units which failed to load are removed.
+// It returns number of removed units.
+func Sweep(s *Store, dir, kind string) (int, error) {
+	prefix := strings.TrimSuffix(filepath.ToSlash(dir), "/") + "/"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stale []string
+	for unit, state := range s.manifest {
+		if strings.HasPrefix(unit, prefix) && !state.Crawled.Equal(s.log.Time) {
+			stale = append(stale, unit)
+		}
+	}
+	sort.Strings(stale)
+
+	for _, unit := range stale {
+		fn := filepath.Join(s.dir, filepath.FromSlash(unit))
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+
+		changes := make([]Change, 0, len(s.manifest[unit].Items))
+		changed := make(map[string]struct{}, len(s.manifest[unit].Items))
+		for id := range s.manifest[unit].Items {
+			changes = append(changes, Change{kind, unit, id, OpRemoved, s.log.Time})
+			changed[id] = struct{}{}
+		}
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].ID < changes[j].ID
+		})
+
+		delete(s.manifest, unit)
+		s.record(unit, changed, changes)
+	}
+
+	return len(stale), nil
+}
+
+// Log returns change log of current run so far
+func (s *Store) Log() *Log {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.log
+	l.Units = make(map[string]time.Time, len(s.log.Units))
+	for unit, t := range s.log.Units {
+		l.Units[unit] = t
+	}
+	l.Changes = append([]Change(nil), s.log.Changes...)
+	return &l
+}
+
+// Close saves manifest and change log.
+// It must be called even if crawl failed, otherwise changes of written units are lost.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeFile(filepath.Join(s.dir, ManifestFile), s.manifest); err != nil {
+		return errors.Wrap(err, "Failed to save manifest")
+	}
+
+	if err := writeFile(filepath.Join(s.dir, ChangesFile), &s.log); err != nil {
+		return errors.Wrap(err, "Failed to save change log")
+	}
+
+	return nil
+}
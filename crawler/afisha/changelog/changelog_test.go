@@ -0,0 +1,214 @@
+package changelog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type item struct {
+	ID    string `json:"id"`
+	Value int    `json:"value"`
+}
+
+func itemKey(it *item) string { return it.ID }
+
+func run(t *testing.T, dir string, items []item) (*Log, bool) {
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := Save(s, "places/moscow.json", "place", items, itemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, written
+}
+
+// ack acknowledges all units of l like fill does
+func ack(t *testing.T, dir string, l *Log) {
+	var units []string
+	for unit := range l.Units {
+		units = append(units, unit)
+	}
+	if err := Acknowledge(dir, l, units); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+
+	l, written := run(t, dir, []item{{"a", 1}, {"b", 2}})
+	if !written || !l.UnitChanged("places/moscow.json") || l.Count("place", OpNew) != 2 {
+		t.Errorf("Expected 2 new items on first run, got %+v", l)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "places", "moscow.json")); err != nil {
+		t.Errorf("Unit isn't written: %v", err)
+	}
+	ack(t, dir, l)
+
+	l, written = run(t, dir, []item{{"a", 1}, {"b", 2}})
+	if written || l.UnitChanged("places/moscow.json") || len(l.Changes) != 0 {
+		t.Errorf("Expected no changes on same items, got %+v", l)
+	}
+
+	// Unchanged units are still recorded as crawled by the run
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crawled, ok := m.Crawled("places/moscow.json"); !ok || !crawled.Equal(l.Time) {
+		t.Errorf("Expected unit to be crawled at %v, got %v", l.Time, crawled)
+	}
+
+	l, written = run(t, dir, []item{{"a", 1}, {"b", 3}, {"c", 4}})
+	if !written || l.Count("place", OpChanged) != 1 || l.Count("place", OpNew) != 1 || len(l.Changes) != 2 {
+		t.Errorf("Expected one changed and one new item, got %+v", l)
+	}
+	ack(t, dir, l)
+
+	l, written = run(t, dir, []item{{"c", 4}})
+	if !written || !l.UnitChanged("places/moscow.json") || len(l.Changes) != 2 || l.Count("place", OpRemoved) != 2 {
+		t.Errorf("Expected two removed items, got %+v", l)
+	}
+	if removed := l.Removed("place", "places"); len(removed) != 2 || removed[0].ID != "a" || removed[1].ID != "b" {
+		t.Errorf("Unexpected removed places: %+v", removed)
+	}
+}
+
+func TestStoreMergesUnacknowledged(t *testing.T) {
+	dir := t.TempDir()
+
+	run(t, dir, []item{{"a", 1}, {"b", 2}})
+	l, _ := run(t, dir, []item{{"a", 2}, {"b", 2}})
+
+	// Changes of first run are kept until fill acknowledges them,
+	// and only the last change of item is kept
+	if !l.UnitChanged("places/moscow.json") || len(l.Changes) != 2 || l.Count("place", OpNew) != 1 || l.Count("place", OpChanged) != 1 {
+		t.Errorf("Expected changes of both runs, got %+v", l)
+	}
+
+	// Unit written after fill loaded change log stays in it after acknowledgement
+	loaded := l
+	l, _ = run(t, dir, []item{{"a", 3}, {"b", 2}})
+	ack(t, dir, loaded)
+
+	l, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.UnitChanged("places/moscow.json") || len(l.Changes) != 1 || l.Changes[0].ID != "a" {
+		t.Errorf("Expected change of unacknowledged run, got %+v", l)
+	}
+
+	ack(t, dir, l)
+	l, _ = run(t, dir, []item{{"a", 3}, {"b", 2}})
+	if l.UnitChanged("places/moscow.json") || len(l.Changes) != 0 {
+		t.Errorf("Expected acknowledged changes to be dropped, got %+v", l)
+	}
+}
+
+func TestAcknowledgeBackToBack(t *testing.T) {
+	dir := t.TempDir()
+	run(t, dir, []item{{"a", 1}})
+
+	// Fills without crawls between them only load the unit once
+	for i := 0; i < 3; i++ {
+		l, err := Load(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := l.UnitChanged("places/moscow.json"); changed != (i == 0) {
+			t.Errorf("Fill %d: unit changed is %v, got %+v", i+1, changed, l)
+		}
+		ack(t, dir, l)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+
+	save := func(s *Store, unit string, items []item) {
+		if _, err := Save(s, unit, "session", items, itemKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(s, "schedule/2019-06-01/moscow/p1.json", []item{{"a", 1}})
+	save(s, "schedule/2019-06-01/moscow/p2.json", []item{{"b", 1}, {"c", 1}})
+	save(s, "schedule/2019-06-01/kazan/p3.json", []item{{"d", 1}})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack(t, dir, l)
+
+	// Second run doesn't produce p2 anymore, and doesn't crawl kazan
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(s, "schedule/2019-06-01/moscow/p1.json", []item{{"a", 1}})
+	n, err := Sweep(s, "schedule/2019-06-01/moscow", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected one removed unit, got %d", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "schedule", "2019-06-01", "moscow", "p2.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected removed unit file to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "schedule", "2019-06-01", "kazan", "p3.json")); err != nil {
+		t.Errorf("Unit outside of swept dir is removed: %v", err)
+	}
+
+	l, err = Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := l.Removed("session", "schedule/2019-06-01")
+	if !l.UnitChanged("schedule/2019-06-01/moscow/p2.json") || len(removed) != 2 || removed[0].ID != "b" || removed[1].ID != "c" {
+		t.Errorf("Expected items of removed unit to be recorded, got %+v", l)
+	}
+
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["schedule/2019-06-01/moscow/p2.json"]; ok {
+		t.Errorf("Removed unit is still in manifest")
+	}
+
+	// Removed unit stays acknowledged until crawl drops it from change log
+	for i := 0; i < 2; i++ {
+		ack(t, dir, l)
+		if l, err = Load(dir); err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Units) != 0 {
+			t.Errorf("Expected acknowledged removal not to be loaded again, got %+v", l)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Package config loads settings of crawl, fill and kinod from YAML file
+// and environment, and applies them to command flags.
+//
+// Settings are applied with precedence: command line flags, environment,
+// config file, flag defaults. Every key can be overridden with environment
+// variable named KINO_ and key in upper case with dots replaced by
+// underscores, like KINO_DB_CONN for db.conn.
+//
+// All set values are validated by Load, so invalid shared config is reported
+// by every command, even by one which doesn't use the setting.
+//
+// Config only holds settings, actions like -do-places or -fill-sessions
+// are still chosen with flags.
+//
+// Example config:
+//
+//	storage:
+//	  backend: fs
+//	  dir: /var/lib/kino/out
+//	db:
+//	  conn: postgres://kino@localhost/kino?sslmode=disable
+//	afisha:
+//	  rate_limit: 5
+//	cities: [moscow, saint-petersburg]
+//	dates:
+//	  schedules: today+1
+//	paging:
+//	  workers: 4
+//	  retries: 2
+//	  retry_delay: 1s
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes environment variables overriding config keys
+const EnvPrefix = "KINO_"
+
+// StorageFS is storage backend keeping crawl results as files in output dir, it's the only one supported
+const StorageFS = "fs"
+
+// option is config key applied to flags
+type option struct {
+	key string
+	// flags are set to option value, only ones defined by command are set
+	flags []string
+	// check validates value, empty values aren't checked
+	check func(v string) error
+}
+
+var options = []option{
+	{"storage.backend", []string{"storage-backend"}, oneOf(StorageFS)},
+	{"storage.dir", []string{"out"}, nil},
+	{"db.conn", []string{"conn"}, nil},
+	{"afisha.url", []string{"afisha-url"}, nil},
+	{"afisha.rate_limit", []string{"rate-limit"}, nonNegative},
+	{"cities", []string{"cities"}, nil},
+	{"city_list", []string{"city-list"}, nil},
+	{"dates.schedules", []string{"schedule-dates"}, dates},
+	{"paging.workers", []string{"paging-workers"}, positive},
+	{"paging.max_items", []string{"paging-max-items"}, nonNegative},
+	{"paging.retries", []string{"paging-retries"}, nonNegative},
+	{"paging.retry_delay", []string{"paging-retry-delay"}, duration},
+	{"log.level", []string{"log-level"}, oneOf("debug", "info", "warn", "error")},
+	{"log.format", []string{"log-format"}, oneOf("text", "json")},
+	{"metrics.addr", []string{"metrics-addr"}, nil},
+}
+
+func oneOf(values ...string) func(v string) error {
+	return func(v string) error {
+		for _, allowed := range values {
+			if strings.EqualFold(v, allowed) {
+				return nil
+			}
+		}
+		return errors.Errorf("must be one of %v", strings.Join(values, ", "))
+	}
+}
+
+func nonNegative(v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return errors.New("must be a non-negative number")
+	}
+	return nil
+}
+
+func positive(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return errors.New("must be a positive integer")
+	}
+	return nil
+}
+
+func duration(v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return errors.New("must be a non-negative duration, like 1s or 500ms")
+	}
+	return nil
+}
+
+func dates(v string) error {
+	_, err := afisha.ParseDates(v, afisha.Today())
+	return err
+}
+
+// EnvName returns name of environment variable overriding key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// value is option value with its source for error messages
+type value struct {
+	value  string
+	source string
+}
+
+// Config is loaded settings
+type Config struct {
+	values map[string]value
+}
+
+// Load loads config file fn, if it's not empty, and overrides it with environment
+func Load(fn string) (*Config, error) {
+	c := &Config{values: map[string]value{}}
+
+	if fn != "" {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read config")
+		}
+
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, errors.Wrapf(err, "Failed to parse config %v", fn)
+		}
+		if len(doc.Content) != 0 {
+			if err := c.load(fn, "", doc.Content[0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, opt := range options {
+		env := EnvName(opt.key)
+		if v, ok := os.LookupEnv(env); ok {
+			c.values[opt.key] = value{v, "$" + env}
+		}
+	}
+
+	for _, opt := range options {
+		if opt.check == nil {
+			continue
+		}
+		if v, ok := c.values[opt.key]; ok && v.value != "" {
+			if err := opt.check(v.value); err != nil {
+				return nil, errors.Errorf("Invalid %v `%v` in %v: %v", opt.key, v.value, v.source, err)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// load flattens YAML mapping node into values with keys prefixed by prefix
+func (c *Config) load(fn, prefix string, node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return errors.Errorf("%v:%d: expected mapping", fn, node.Line)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valNode := node.Content[i], node.Content[i+1]
+		key := prefix + keyNode.Value
+
+		if valNode.Kind == yaml.MappingNode {
+			if err := c.load(fn, key+".", valNode); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !known(key) {
+			return errors.Errorf("%v:%d: unknown key %v", fn, keyNode.Line, key)
+		}
+
+		source := fmt.Sprintf("%v:%d", fn, valNode.Line)
+		switch valNode.Kind {
+		case yaml.ScalarNode:
+			c.values[key] = value{valNode.Value, source}
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(valNode.Content))
+			for _, item := range valNode.Content {
+				if item.Kind != yaml.ScalarNode {
+					return errors.Errorf("%v:%d: %v must be a list of strings", fn, item.Line, key)
+				}
+				items = append(items, item.Value)
+			}
+			c.values[key] = value{strings.Join(items, ","), source}
+		default:
+			return errors.Errorf("%v:%d: unexpected value of %v", fn, valNode.Line, key)
+		}
+	}
+
+	return nil
+}
+
+func known(key string) bool {
+	for _, opt := range options {
+		if opt.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns value of key, or empty string if it's not set
+func (c *Config) Get(key string) string {
+	return c.values[key].value
+}
+
+// Apply sets flags of fs which weren't set on command line to config values,
+// and validates resulting flag values
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, opt := range options {
+		for _, name := range opt.flags {
+			f := fs.Lookup(name)
+			if f == nil {
+				continue
+			}
+
+			source := "flag -" + name
+			if v, ok := c.values[opt.key]; ok && !set[name] {
+				source = v.source
+				if err := fs.Set(name, v.value); err != nil {
+					// Checks explain expected values better than flag parse errors
+					if opt.check != nil {
+						if checkErr := opt.check(v.value); checkErr != nil {
+							err = checkErr
+						}
+					}
+					return errors.Errorf("Invalid %v `%v` in %v: %v", opt.key, v.value, source, err)
+				}
+			}
+
+			if v := f.Value.String(); opt.check != nil && v != "" {
+				if err := opt.check(v); err != nil {
+					return errors.Errorf("Invalid %v `%v` in %v: %v", opt.key, v, source, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// RegisterFlags registers -config flag, defaulting to $KINO_CONFIG
+func RegisterFlags(fs *flag.FlagSet) *string {
+	return fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "YAML config file, its settings are overridden by KINO_* environment and flags")
+}
+
+// RegisterStorageFlags registers -storage-backend flag of commands using crawl output dir
+func RegisterStorageFlags(fs *flag.FlagSet) *string {
+	return fs.String("storage-backend", StorageFS, "Storage backend of crawl results, only "+StorageFS+" (files in -out dir) is supported")
+}
+
+// Setup loads config file fn and applies it to parsed flags of fs
+func Setup(fs *flag.FlagSet, fn string) error {
+	c, err := Load(fn)
+	if err != nil {
+		return err
+	}
+	return c.Apply(fs)
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	fn := filepath.Join(t.TempDir(), "kino.yaml")
+	if err := os.WriteFile(fn, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+type testFlags struct {
+	fs      *flag.FlagSet
+	backend *string
+	out     *string
+	conn    *string
+	cities  *string
+	workers *int
+	delay   *time.Duration
+}
+
+func newTestFlags(args ...string) testFlags {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := testFlags{
+		fs:      fs,
+		backend: RegisterStorageFlags(fs),
+		out:     fs.String("out", "", ""),
+		conn:    fs.String("conn", "", ""),
+		cities:  fs.String("cities", "", ""),
+		workers: fs.Int("paging-workers", 1, ""),
+		delay:   fs.Duration("paging-retry-delay", time.Second, ""),
+	}
+	if err := fs.Parse(args); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func TestApply(t *testing.T) {
+	fn := writeConfig(t, `
+storage:
+  backend: fs
+  dir: /var/lib/kino
+db:
+  conn: postgres://file
+cities: [moscow, kazan]
+paging:
+  workers: 4
+  retry_delay: 500ms
+`)
+	t.Setenv("KINO_DB_CONN", "postgres://env")
+
+	f := newTestFlags("-paging-workers", "2")
+	if err := Setup(f.fs, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	if *f.out != "/var/lib/kino" || *f.backend != StorageFS || *f.cities != "moscow,kazan" || *f.delay != 500*time.Millisecond {
+		t.Errorf("Config values are not applied: out=%v cities=%v delay=%v", *f.out, *f.cities, *f.delay)
+	}
+	if *f.conn != "postgres://env" {
+		t.Errorf("Expected environment to override config, got %v", *f.conn)
+	}
+	if *f.workers != 2 {
+		t.Errorf("Expected flag to override config, got %v", *f.workers)
+	}
+}
+
+func TestEnvOnly(t *testing.T) {
+	t.Setenv("KINO_STORAGE_DIR", "/tmp/out")
+
+	f := newTestFlags()
+	if err := Setup(f.fs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if *f.out != "/tmp/out" {
+		t.Errorf("Expected out from environment, got %v", *f.out)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, c := range []struct {
+		config string
+		env    string
+		args   []string
+		want   string
+	}{
+		{config: "paging:\n  worker: 4\n", want: "kino.yaml:2: unknown key paging.worker"},
+		{config: "paging:\n  workers: four\n", want: "Invalid paging.workers `four` in"},
+		{config: "paging:\n  workers: 0\n", want: "paging.workers `0` in %dir%/kino.yaml:2: must be a positive integer"},
+		{config: "storage:\n  backend: s3\n", want: "storage.backend `s3` in %dir%/kino.yaml:2: must be one of fs"},
+		{config: "paging:\n  retry_delay: -1s\n", want: "must be a non-negative duration"},
+		{env: "0", want: "paging.workers `0` in $KINO_PAGING_WORKERS"},
+		{args: []string{"-paging-workers", "-1"}, want: "paging.workers `-1` in flag -paging-workers"},
+	} {
+		t.Run(c.want, func(t *testing.T) {
+			fn := ""
+			if c.config != "" {
+				fn = writeConfig(t, c.config)
+			}
+			if c.env != "" {
+				t.Setenv("KINO_PAGING_WORKERS", c.env)
+			}
+
+			err := Setup(newTestFlags(c.args...).fs, fn)
+			want := strings.Replace(c.want, "%dir%", filepath.Dir(fn), 1)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("Expected error containing %q, got %v", want, err)
+			}
+		})
+	}
+}
+
+func TestLoadValidatesAll(t *testing.T) {
+	// Command without paging or dates flags still reports invalid shared config
+	for _, c := range []struct {
+		config string
+		want   string
+	}{
+		{"paging:\n  workers: 0\n", "paging.workers `0` in %dir%/kino.yaml:2: must be a positive integer"},
+		{"dates:\n  schedules: tomorrow\n", "dates.schedules `tomorrow` in %dir%/kino.yaml:2"},
+		{"log:\n  format: xml\n", "log.format `xml` in %dir%/kino.yaml:2: must be one of text, json"},
+	} {
+		fn := writeConfig(t, c.config)
+		err := Setup(flag.NewFlagSet("test", flag.ContinueOnError), fn)
+		want := strings.Replace(c.want, "%dir%", filepath.Dir(fn), 1)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error containing %q, got %v", want, err)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("afisha.rate_limit"); got != "KINO_AFISHA_RATE_LIMIT" {
+		t.Errorf("EnvName is %v", got)
+	}
+}
@@ -1,20 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/changelog"
+	"github.com/stek29/kr/crawler/afisha/config"
+	"github.com/stek29/kr/crawler/afisha/logging"
+	"github.com/stek29/kr/crawler/afisha/metrics"
 	"github.com/stek29/kr/crawler/afisha/util"
 )
 
 const (
+	citiesFile     = "cities.json"
 	repertoriesDir = "repertories"
 	placesDir      = "places"
 	scheduleDir    = "schedule"
@@ -23,10 +33,40 @@ const (
 var (
 	cities []string
 	outDir string
+	paging afisha.PagingOptions
+	units  *changelog.Store
 )
 
+func cityKey(city *afisha.City) string            { return city.ID }
+func placeKey(pl *afisha.Place) string            { return pl.ID }
+func eventKey(item *afisha.RepertoryItem) string  { return item.Event.ID }
+func sessionKey(item *afisha.ScheduleItem) string { return afisha.ScheduleItemKey(item) }
+
+// crawlCities saves all cities supported by Afisha, and uses them as city list if it's empty
+func crawlCities() error {
+	slog.Info("Crawling cities")
+
+	allCities, err := afisha.GetCities(context.Background(), client, &afisha.CitiesParams{Lang: "ru"})
+	if err != nil {
+		return errors.Wrap(err, "Failed to get cities")
+	}
+	slog.Info("Loaded cities", "count", len(allCities))
+
+	if _, err := changelog.Save(units, citiesFile, "city", allCities, cityKey); err != nil {
+		return errors.Wrap(err, "Failed to save cities")
+	}
+
+	if len(cities) == 0 {
+		for _, city := range allCities {
+			cities = append(cities, city.ID)
+		}
+	}
+
+	return nil
+}
+
 func crawlCityRepertories() error {
-	log.Println("Crawling repertories by Cities")
+	slog.Info("Crawling repertories by cities")
 
 	repertoriesPath := path.Join(outDir, repertoriesDir)
 	if err := os.MkdirAll(repertoriesPath, 0755); err != nil {
@@ -34,22 +74,27 @@ func crawlCityRepertories() error {
 	}
 
 	for _, city := range cities {
+		stats.target(city, kindEvents)
+
 		params := afisha.RepertoryParams{
 			Limit:  20,
 			Offset: 0,
 			City:   city,
+			Paging: paging,
 		}
 
-		allEvents, err := afisha.GetRepetoryFull(http.DefaultClient, &params)
+		allEvents, err := afisha.GetRepetoryFull(client, &params)
 		if err != nil {
-			log.Printf("WARN: Failed to get repertory for %v city, skipping: %v", city, err)
+			slog.Warn("Failed to get city repertory, skipping", "city", city, "err", err)
+			stats.error(err)
 			continue
 		}
 
-		fn := path.Join(repertoriesPath, city+".json")
-		err = util.MarshalIntoFile(fn, allEvents.Data)
+		stats.count(city, kindEvents, len(allEvents.Data))
+
+		_, err = changelog.Save(units, path.Join(repertoriesDir, city+".json"), "event", allEvents.Data, eventKey)
 		if err != nil {
-			log.Printf("WARN: failed to save %v city repertory, skipping: %v", city, err)
+			slog.Warn("Failed to save city repertory, skipping", "city", city, "err", err)
 			continue
 		}
 	}
@@ -58,7 +103,7 @@ func crawlCityRepertories() error {
 }
 
 func crawlPlaces() error {
-	log.Println("Crawling repertories by Cities")
+	slog.Info("Crawling places by cities")
 
 	placesPath := path.Join(outDir, placesDir)
 	if err := os.MkdirAll(placesPath, 0755); err != nil {
@@ -66,22 +111,27 @@ func crawlPlaces() error {
 	}
 
 	for _, city := range cities {
+		stats.target(city, kindPlaces)
+
 		params := afisha.PlacesParams{
 			Limit:  20,
 			Offset: 0,
 			City:   city,
+			Paging: paging,
 		}
 
-		allPlaces, err := afisha.GetPlacesFull(http.DefaultClient, &params)
+		allPlaces, err := afisha.GetPlacesFull(client, &params)
 		if err != nil {
-			log.Printf("WARN: Failed to get places for %v city, skipping: %v", city, err)
+			slog.Warn("Failed to get city places, skipping", "city", city, "err", err)
+			stats.error(err)
 			continue
 		}
 
-		fn := path.Join(placesPath, city+".json")
-		err = util.MarshalIntoFile(fn, allPlaces.Items)
+		stats.count(city, kindPlaces, len(allPlaces.Items))
+
+		_, err = changelog.Save(units, path.Join(placesDir, city+".json"), "place", allPlaces.Items, placeKey)
 		if err != nil {
-			log.Printf("WARN: failed to save %v city places, skipping: %v", city, err)
+			slog.Warn("Failed to save city places, skipping", "city", city, "err", err)
 			continue
 		}
 	}
@@ -95,20 +145,36 @@ type placeInfo struct {
 	city    string
 }
 
+// loadPlaces loads crawled places, limited to city list if it's set
 func loadPlaces() ([]placeInfo, error) {
 	placeFiles, err := filepath.Glob(path.Join(outDir, placesDir, "*"))
 	if err != nil {
 		return nil, errors.Wrap(err, "Place files Glob failed: ")
 	}
-	log.Printf("Loading places from %v files", len(placeFiles))
+
+	if len(cities) != 0 {
+		listed := map[string]struct{}{}
+		for _, city := range cities {
+			listed[city+".json"] = struct{}{}
+		}
+
+		var filtered []string
+		for _, fn := range placeFiles {
+			if _, ok := listed[filepath.Base(fn)]; ok {
+				filtered = append(filtered, fn)
+			}
+		}
+		placeFiles = filtered
+	}
+	slog.Info("Loading places", "files", len(placeFiles))
 
 	var places []placeInfo
 
 	for i, fn := range placeFiles {
-		log.Printf("INFO: Loading place file #%d (%v)", i, fn)
+		slog.Debug("Loading place file", "index", i, "file", fn)
 		var chunk []afisha.Place
 		if err := util.UnmarshalFromFile(fn, &chunk); err != nil {
-			log.Printf("Failed to load file, skipping: %v", err)
+			slog.Warn("Failed to load place file, skipping", "file", fn, "err", err)
 			continue
 		}
 
@@ -124,54 +190,197 @@ func loadPlaces() ([]placeInfo, error) {
 	return places, nil
 }
 
-func crawlPlaceSchedules(dateStr string) error {
-	date, err := afisha.ParseDate(dateStr)
+// placeScheduleDates returns dates with sessions in place according to its repertory
+func placeScheduleDates(pl placeInfo) (map[afisha.Date]struct{}, error) {
+	params := afisha.RepertoryParams{
+		PlaceID: pl.placeID,
+		City:    pl.city,
+		Limit:   20,
+		Paging:  paging,
+	}
+
+	rep, err := afisha.GetRepetoryFull(client, &params)
 	if err != nil {
-		return errors.Wrapf(err, "Invalid date for do-place-schedules: `%v`", dateStr)
+		return nil, err
+	}
+
+	dates := map[afisha.Date]struct{}{}
+	for _, item := range rep.Data {
+		for _, date := range item.ScheduleInfo.Dates {
+			dates[date] = struct{}{}
+		}
 	}
 
+	return dates, nil
+}
+
+// crawlPlaceSchedules crawls schedules of all places for dates.
+// If fromRepertory is set, only dates which have sessions according to place repertory are crawled.
+func crawlPlaceSchedules(dates []afisha.Date, fromRepertory bool) error {
 	places, err := loadPlaces()
 	if err != nil {
 		return errors.Wrap(err, "Failed to load places")
 	}
 
-	log.Printf("Loaded %v places", len(places))
+	slog.Info("Loaded places", "count", len(places))
+
+	return crawlPlacesSchedules(places, dates, fromRepertory)
+}
 
-	schedulesPath := path.Join(outDir, scheduleDir, date.String())
-	if err := os.MkdirAll(schedulesPath, 0755); err != nil {
-		return errors.Wrap(err, "Failed to prepare schedules dir")
+// crawlPlacesSchedules crawls schedules of places for dates, see crawlPlaceSchedules.
+// Schedules of places which weren't crawled, like ones without sessions in repertory,
+// are removed for cities and dates whose schedules were all crawled.
+func crawlPlacesSchedules(places []placeInfo, dates []afisha.Date, fromRepertory bool) error {
+	for _, date := range dates {
+		schedulesPath := path.Join(outDir, scheduleDir, date.String())
+		if err := os.MkdirAll(schedulesPath, 0755); err != nil {
+			return errors.Wrap(err, "Failed to prepare schedules dir")
+		}
 	}
 
+	var cityIDs []string
+	seenCities := map[string]struct{}{}
+	// failed marks cities and dates, joined with /, with schedules which failed to crawl
+	failed := map[string]bool{}
+
+	skipped := 0
 	for i, pl := range places {
-		log.Printf("INFO: Processing place %d/%d (%s - %s from city %s)", i+1, len(places), pl.placeID, pl.title, pl.city)
+		if _, ok := seenCities[pl.city]; !ok {
+			seenCities[pl.city] = struct{}{}
+			cityIDs = append(cityIDs, pl.city)
+		}
 
-		outPath := path.Join(schedulesPath, pl.city)
-		if err := os.MkdirAll(outPath, 0755); err != nil {
-			log.Printf("WARN: Failed to prepare schedules dir for places of city %v, skipping place %v: %v", pl.city, pl.placeID, err)
-			continue
+		slog.Info("Processing place", "index", i+1, "total", len(places), "place", pl.placeID, "title", pl.title, "city", pl.city)
+		stats.target(pl.city, kindSessions)
+
+		var placeDates map[afisha.Date]struct{}
+		if fromRepertory {
+			var err error
+			placeDates, err = placeScheduleDates(pl)
+			if err != nil {
+				slog.Warn("Failed to load place repertory, crawling all dates", "place", pl.placeID, "city", pl.city, "err", err)
+				stats.error(err)
+			}
 		}
 
-		params := afisha.ScheduleCinemaParams{
-			PlaceID: pl.placeID,
-			City:    pl.city,
-			Date:    date,
-			Limit:   20,
+		for _, date := range dates {
+			if placeDates != nil {
+				if _, ok := placeDates[date]; !ok {
+					skipped++
+					continue
+				}
+			}
+
+			if !crawlPlaceSchedule(pl, date) {
+				failed[pl.city+"/"+date.String()] = true
+			}
 		}
+	}
 
-		schd, err := afisha.GetScheduleCinemaFull(http.DefaultClient, &params)
-		if err != nil {
-			log.Printf("WARN: Failed to load schedules for place %v (city=%v), skipping: %v", pl.placeID, pl.city, err)
-			continue
+	if fromRepertory {
+		slog.Info("Skipped place schedules without sessions in repertory", "count", skipped)
+	}
+
+	for _, city := range cityIDs {
+		for _, date := range dates {
+			if !failed[city+"/"+date.String()] {
+				sweepSchedules(city, date)
+			}
 		}
+	}
+
+	return nil
+}
 
-		if len(schd.Items) == 0 {
-			log.Printf("WARN: Failed to load schedules for place %v (city=%v), skipping: %v", pl.placeID, pl.city, "no items received")
+// crawlPlaceSchedule crawls and saves schedule of place for date, it returns false if it failed
+func crawlPlaceSchedule(pl placeInfo, date afisha.Date) bool {
+	params := afisha.ScheduleCinemaParams{
+		PlaceID: pl.placeID,
+		City:    pl.city,
+		Date:    date,
+		Limit:   20,
+		Paging:  paging,
+	}
+
+	schd, err := afisha.GetScheduleCinemaFull(client, &params)
+	if err != nil {
+		slog.Warn("Failed to load place schedule, skipping", "place", pl.placeID, "city", pl.city, "date", date, "err", err)
+		stats.error(err)
+		return false
+	}
+
+	if len(schd.Items) == 0 {
+		slog.Warn("No schedule items received for place", "place", pl.placeID, "city", pl.city, "date", date)
+	}
+	stats.count(pl.city, kindSessions, countSessions(schd.Items))
+
+	_, err = changelog.Save(units, path.Join(scheduleDir, date.String(), pl.city, pl.placeID+".json"), "session", schd.Items, sessionKey)
+	if err != nil {
+		slog.Warn("Failed to save place schedule, skipping", "place", pl.placeID, "city", pl.city, "date", date, "err", err)
+		return false
+	}
+	return true
+}
+
+// parseDatesFlag parses dates of flag name, empty value means no dates
+func parseDatesFlag(name, value string) []afisha.Date {
+	if value == "" {
+		return nil
+	}
+
+	dates, err := afisha.ParseDates(value, afisha.Today())
+	if err != nil {
+		logging.Fatal("Invalid dates for "+name, "dates", value, "err", err)
+	}
+	return dates
+}
+
+// crawlActions are crawls requested with flags
+type crawlActions struct {
+	cities          bool
+	cityRepertories bool
+	places          bool
+	placeSchedules  []afisha.Date
+	eventSchedules  []afisha.Date
+	schedules       []afisha.Date
+	fromRepertory   bool
+}
+
+// run runs requested crawls in order, stopping at first failed one
+func (a crawlActions) run() error {
+	if a.cities {
+		if err := crawlCities(); err != nil {
+			return errors.Wrap(err, "Failed to crawl cities")
 		}
+	}
 
-		util.MarshalIntoFile(path.Join(outPath, pl.placeID+".json"), schd.Items)
-		if err != nil {
-			log.Printf("WARN: Failed to save schedules for place %v (city=%v), skipping: %v", pl.placeID, pl.city, err)
-			continue
+	if a.cityRepertories {
+		if err := crawlCityRepertories(); err != nil {
+			return errors.Wrap(err, "Failed to crawl city repertories")
+		}
+	}
+
+	if a.places {
+		if err := crawlPlaces(); err != nil {
+			return errors.Wrap(err, "Failed to crawl city places")
+		}
+	}
+
+	if len(a.placeSchedules) != 0 {
+		if err := crawlPlaceSchedules(a.placeSchedules, a.fromRepertory); err != nil {
+			return errors.Wrap(err, "Failed to crawl place schedules")
+		}
+	}
+
+	if len(a.eventSchedules) != 0 {
+		if err := crawlSchedules(a.eventSchedules, eventStrategy, a.fromRepertory); err != nil {
+			return errors.Wrap(err, "Failed to crawl event schedules")
+		}
+	}
+
+	if len(a.schedules) != 0 {
+		if err := crawlSchedules(a.schedules, autoStrategy, a.fromRepertory); err != nil {
+			return errors.Wrap(err, "Failed to crawl schedules")
 		}
 	}
 
@@ -179,54 +388,125 @@ func crawlPlaceSchedules(dateStr string) error {
 }
 
 func main() {
-	cityListFile := flag.String("city-list", "", "City list in JSON")
+	configFile := config.RegisterFlags(flag.CommandLine)
+	cityListFile := flag.String("city-list", "", "City list in JSON, schedules are only crawled for its cities if set")
+	cityNames := flag.String("cities", "", "Comma separated city list, used if -city-list isn't set")
 
+	doCities := flag.Bool("do-cities", false, "Crawl list of all cities, used as city list if -city-list isn't set")
 	doCityRepertories := flag.Bool("do-city-repertories", false, "Crawl repertories by city")
 	doPlaces := flag.Bool("do-places", false, "Crawl places by city")
 
-	doPlaceSchedules := flag.String("do-place-schedules", "", "Crawl schedule for all places for specific date")
+	doEventSchedules := flag.String("do-event-schedules", "", "Crawl schedule for all events of city repertories for dates, same format as do-place-schedules")
+	doSchedules := flag.String("do-schedules", "", "Crawl schedule for dates picking place or event strategy per city, same format as do-place-schedules")
+	doPlaceSchedules := flag.String("do-place-schedules", "", "Crawl schedule for all places for dates (comma separated, ranges like 2019-06-01..2019-06-07 or today+7)")
+	schedulesFromRepertory := flag.Bool("schedules-from-repertory", false, "Only crawl place schedules for dates with sessions in place repertory")
 
 	flag.StringVar(&outDir, "out", "", "Crawl result output dir")
+	storageBackend := config.RegisterStorageFlags(flag.CommandLine)
+	flag.StringVar(&afisha.BaseURL, "afisha-url", afisha.BaseURL, "Yandex.Afisha base URL")
+	flag.IntVar(&paging.Workers, "paging-workers", 1, "Number of pages loaded concurrently")
+	flag.IntVar(&paging.MaxItems, "paging-max-items", 0, "Max number of items loaded per request, 0 means no limit")
+	flag.IntVar(&paging.Retries, "paging-retries", 2, "Number of retries of failed page requests")
+	flag.DurationVar(&paging.RetryDelay, "paging-retry-delay", time.Second, "Delay before first retry of failed page request")
+	anomalyThreshold := flag.Float64("anomaly-threshold", 0.5, "Warn if city counts dropped by more than this fraction since the last run which crawled them")
+	rateLimit := flag.Float64("rate-limit", 0, "Max Afisha requests per second, 0 means no limit")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at address, like :9100")
+
+	var logOpts logging.Options
+	logOpts.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := config.Setup(flag.CommandLine, *configFile); err != nil {
+		logging.Fatal("Invalid config", "err", err)
+	}
+
+	if _, err := logOpts.Setup(); err != nil {
+		logging.Fatal("Invalid logging flags", "err", err)
+	}
+
+	// Rate limiter waits outside of stats and metrics, so waits aren't measured as request latency
+	client.Transport = afisha.RateLimited(newTransport(http.DefaultTransport), *rateLimit)
+
+	if *metricsAddr != "" {
+		metrics.Serve(*metricsAddr)
+	}
+
+	paging.OnRetry = stats.retry
+
 	if outDir == "" {
-		log.Fatal("-out is required")
+		logging.Fatal("-out is required")
 	}
 
 	if *cityListFile != "" {
-		log.Println("Loading City List")
+		slog.Info("Loading city list", "file", *cityListFile)
 		if err := util.UnmarshalFromFile(*cityListFile, &cities); err != nil {
-			log.Fatalf("Failed to load city list from %v: %v", *cityListFile, err)
+			logging.Fatal("Failed to load city list", "file", *cityListFile, "err", err)
 		}
-		log.Printf("Loaded %v cities", len(cities))
-	} else if *doCityRepertories || *doPlaces {
-		log.Fatal("City list is required for do-city-repertories/do-places")
+		slog.Info("Loaded city list", "count", len(cities))
+	} else if *cityNames != "" {
+		cities = strings.Split(*cityNames, ",")
+	} else if (*doCityRepertories || *doPlaces) && !*doCities {
+		logging.Fatal("City list, cities or do-cities is required for do-city-repertories/do-places")
 	}
 
 	if err := os.MkdirAll(outDir, 0755); err != nil {
-		log.Fatal("Failed to prepare output dir", err)
+		logging.Fatal("Failed to prepare output dir", "err", err)
 	}
 
-	log.Printf("Prepared output dir")
+	slog.Debug("Prepared output dir", "dir", outDir, "storage", *storageBackend)
 
-	if *doCityRepertories {
-		if err := crawlCityRepertories(); err != nil {
-			log.Fatalf("Failed to crawl city repertories: %v", err)
-		}
+	actions := crawlActions{
+		cities:          *doCities,
+		cityRepertories: *doCityRepertories,
+		places:          *doPlaces,
+		placeSchedules:  parseDatesFlag("do-place-schedules", *doPlaceSchedules),
+		eventSchedules:  parseDatesFlag("do-event-schedules", *doEventSchedules),
+		schedules:       parseDatesFlag("do-schedules", *doSchedules),
+		fromRepertory:   *schedulesFromRepertory,
 	}
 
-	if *doPlaces {
-		if err := crawlPlaces(); err != nil {
-			log.Fatalf("Failed to crawl city places: %v", err)
-		}
+	var err error
+	units, err = changelog.Open(outDir)
+	if err != nil {
+		logging.Fatal("Failed to open change log", "err", err)
 	}
 
-	if plsDate := *doPlaceSchedules; plsDate != "" {
-		dates := strings.Split(plsDate, ",")
-		for _, date := range dates {
-			if err := crawlPlaceSchedules(date); err != nil {
-				log.Fatalf("Failed to crawl date: `%v` (%v)", date, err)
+	var closeOnce sync.Once
+	closeUnits := func() {
+		closeOnce.Do(func() {
+			if err := units.Close(); err != nil {
+				logging.Fatal("Failed to save change log", "err", err)
 			}
+
+			l := units.Log()
+			slog.Info("Saved change log", "units", len(l.Units), "changes", len(l.Changes))
+		})
+	}
+
+	// Change log is saved if crawl is stopped, otherwise changes of already written units are lost
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Warn("Crawl is stopped, saving change log", "signal", sig.String())
+		closeUnits()
+		if err := saveReport(*anomalyThreshold, errors.Errorf("stopped by %v", sig)); err != nil {
+			slog.Error("Failed to save run report", "err", err)
+		}
+		os.Exit(1)
+	}()
+
+	err = actions.run()
+	closeUnits()
+	if err != nil {
+		// Failed crawl is reported too, so its errors can be inspected and it isn't compared against
+		if err := saveReport(*anomalyThreshold, err); err != nil {
+			slog.Error("Failed to save run report", "err", err)
 		}
+		logging.Fatal("Crawl failed", "err", err)
+	}
+
+	if err := saveReport(*anomalyThreshold, nil); err != nil {
+		logging.Fatal("Failed to save run report", "err", err)
 	}
 }
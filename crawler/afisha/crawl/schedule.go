@@ -0,0 +1,240 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/changelog"
+	"github.com/stek29/kr/crawler/afisha/util"
+)
+
+// scheduleStrategy is a way schedules of a city are crawled
+type scheduleStrategy int
+
+const (
+	// autoStrategy picks place or event strategy per city with planSchedules
+	autoStrategy scheduleStrategy = iota
+	// placeStrategy requests schedule of every place
+	placeStrategy
+	// eventStrategy requests schedule of every event in city repertory
+	eventStrategy
+)
+
+func (s scheduleStrategy) String() string {
+	switch s {
+	case placeStrategy:
+		return "place"
+	case eventStrategy:
+		return "event"
+	default:
+		return "auto"
+	}
+}
+
+// schedulePageLimit is page limit used for schedule requests
+const schedulePageLimit = 20
+
+// schedulePlan is planned schedule crawl of a city
+type schedulePlan struct {
+	city     string
+	strategy scheduleStrategy
+
+	// estimated number of requests of each strategy
+	placeRequests int
+	eventRequests int
+}
+
+// eventHasDate checks if event has sessions on date according to repertory,
+// events without schedule dates are expected to have sessions on any date
+func eventHasDate(item *afisha.RepertoryItem, date afisha.Date) bool {
+	if len(item.ScheduleInfo.Dates) == 0 {
+		return true
+	}
+	for _, d := range item.ScheduleInfo.Dates {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// planSchedules estimates number of requests needed to crawl city schedules
+// by places and by events, and picks strategy with fewer requests.
+// Place schedule usually fits in single page, and event schedule is paged by places showing it.
+func planSchedules(city string, places int, repertory []afisha.RepertoryItem, dates []afisha.Date) schedulePlan {
+	plan := schedulePlan{
+		city:          city,
+		placeRequests: places * len(dates),
+	}
+
+	for i := range repertory {
+		pages := (repertory[i].ScheduleInfo.PlacesTotal + schedulePageLimit - 1) / schedulePageLimit
+		if pages < 1 {
+			pages = 1
+		}
+
+		for _, date := range dates {
+			if eventHasDate(&repertory[i], date) {
+				plan.eventRequests += pages
+			}
+		}
+	}
+
+	if plan.eventRequests < plan.placeRequests {
+		plan.strategy = eventStrategy
+	} else {
+		plan.strategy = placeStrategy
+	}
+
+	return plan
+}
+
+func loadCityRepertory(city string) ([]afisha.RepertoryItem, error) {
+	var repertory []afisha.RepertoryItem
+	err := util.UnmarshalFromFile(path.Join(outDir, repertoriesDir, city+".json"), &repertory)
+	return repertory, err
+}
+
+// crawlSchedules crawls schedules of all cities with places for dates using strategy.
+// Event strategy needs city repertories crawled with do-city-repertories,
+// cities without one are crawled by places.
+func crawlSchedules(dates []afisha.Date, strategy scheduleStrategy, fromRepertory bool) error {
+	places, err := loadPlaces()
+	if err != nil {
+		return errors.Wrap(err, "Failed to load places")
+	}
+
+	slog.Info("Loaded places", "count", len(places))
+
+	cityPlaces := map[string][]placeInfo{}
+	for _, pl := range places {
+		cityPlaces[pl.city] = append(cityPlaces[pl.city], pl)
+	}
+
+	cityIDs := make([]string, 0, len(cityPlaces))
+	for city := range cityPlaces {
+		cityIDs = append(cityIDs, city)
+	}
+	sort.Strings(cityIDs)
+
+	for _, city := range cityIDs {
+		repertory, err := loadCityRepertory(city)
+		if err != nil {
+			slog.Warn("Failed to load city repertory, crawling by places", "city", city, "err", err)
+			if err := crawlPlacesSchedules(cityPlaces[city], dates, fromRepertory); err != nil {
+				return err
+			}
+			continue
+		}
+
+		plan := planSchedules(city, len(cityPlaces[city]), repertory, dates)
+		if strategy != autoStrategy {
+			plan.strategy = strategy
+		}
+		slog.Info("Crawling city schedules", "city", city, "strategy", plan.strategy.String(), "place_requests", plan.placeRequests, "event_requests", plan.eventRequests)
+
+		if plan.strategy == eventStrategy {
+			for _, date := range dates {
+				crawlEventSchedules(city, cityPlaces[city], repertory, date)
+			}
+		} else {
+			if err := crawlPlacesSchedules(cityPlaces[city], dates, fromRepertory); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// sweepSchedules removes schedules of city for date which weren't saved by this run,
+// so fill removes their sessions. It must only be called if all schedules of city for date were crawled.
+func sweepSchedules(city string, date afisha.Date) {
+	n, err := changelog.Sweep(units, path.Join(scheduleDir, date.String(), city), "session")
+	if err != nil {
+		slog.Warn("Failed to remove schedules of places without sessions", "city", city, "date", date, "err", err)
+		return
+	}
+	if n != 0 {
+		slog.Info("Removed schedules of places without sessions", "count", n, "city", city, "date", date)
+	}
+}
+
+// crawlEventSchedules crawls schedules of all events in city repertory for date.
+// Items are grouped by place and saved same way as place schedules.
+// Only schedules of crawled city places are saved, since fill only knows them.
+// Schedules of places without sessions are removed if all event schedules were crawled.
+func crawlEventSchedules(city string, places []placeInfo, repertory []afisha.RepertoryItem, date afisha.Date) {
+	stats.target(city, kindSessions)
+	failed := false
+
+	known := map[string]struct{}{}
+	for _, pl := range places {
+		known[pl.placeID] = struct{}{}
+	}
+
+	byPlace := map[string][]afisha.ScheduleItem{}
+	unknown := map[string]struct{}{}
+
+	for i, item := range repertory {
+		if !eventHasDate(&item, date) {
+			continue
+		}
+
+		slog.Info("Processing event", "index", i+1, "total", len(repertory), "event", item.Event.ID, "title", item.Event.Title, "city", city, "date", date)
+
+		params := afisha.ScheduleCinemaParams{
+			EventID: item.Event.ID,
+			City:    city,
+			Date:    date,
+			Limit:   schedulePageLimit,
+			Paging:  paging,
+		}
+
+		schd, err := afisha.GetScheduleCinemaFull(client, &params)
+		if err != nil {
+			slog.Warn("Failed to load event schedule, skipping", "event", item.Event.ID, "city", city, "date", date, "err", err)
+			stats.error(err)
+			failed = true
+			continue
+		}
+
+		for _, si := range schd.Items {
+			if si.Place == nil {
+				slog.Warn("Schedule item has no place, skipping", "event", item.Event.ID, "city", city, "date", date)
+				continue
+			}
+			if _, ok := known[si.Place.ID]; !ok {
+				unknown[si.Place.ID] = struct{}{}
+				continue
+			}
+			if si.Event == nil {
+				ev := item.Event
+				si.Event = &ev
+			}
+			byPlace[si.Place.ID] = append(byPlace[si.Place.ID], si)
+		}
+	}
+
+	for placeID, items := range byPlace {
+		stats.count(city, kindSessions, countSessions(items))
+
+		unit := path.Join(scheduleDir, date.String(), city, placeID+".json")
+		if _, err := changelog.Save(units, unit, "session", items, sessionKey); err != nil {
+			slog.Warn("Failed to save place schedule, skipping", "place", placeID, "city", city, "date", date, "err", err)
+			failed = true
+		}
+	}
+
+	if !failed {
+		sweepSchedules(city, date)
+	}
+
+	if len(unknown) != 0 {
+		slog.Warn("Skipped schedules of places missing in city places, crawl places to save them", "places", len(unknown), "city", city, "date", date)
+	}
+	slog.Info("Saved event schedules", "places", len(byPlace), "city", city, "date", date)
+}
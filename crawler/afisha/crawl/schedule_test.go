@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/afishatest"
+	"github.com/stek29/kr/crawler/afisha/changelog"
+)
+
+func TestPlanSchedules(t *testing.T) {
+	day1, day2 := afisha.MakeDate(2019, 6, 1), afisha.MakeDate(2019, 6, 2)
+	dates := []afisha.Date{day1, day2}
+
+	event := func(placesTotal int, dates ...afisha.Date) afisha.RepertoryItem {
+		var item afisha.RepertoryItem
+		item.ScheduleInfo.PlacesTotal = placesTotal
+		item.ScheduleInfo.Dates = dates
+		return item
+	}
+
+	// Many cinemas and few films
+	plan := planSchedules("moscow", 100, []afisha.RepertoryItem{event(50, day1, day2), event(10, day1)}, dates)
+	if plan.strategy != eventStrategy || plan.placeRequests != 200 || plan.eventRequests != 7 {
+		t.Errorf("Unexpected plan: %+v", plan)
+	}
+
+	// Single cinema with lots of films
+	var rep []afisha.RepertoryItem
+	for i := 0; i < 10; i++ {
+		rep = append(rep, event(1))
+	}
+	plan = planSchedules("abakan", 1, rep, dates)
+	if plan.strategy != placeStrategy || plan.placeRequests != 2 || plan.eventRequests != 20 {
+		t.Errorf("Unexpected plan: %+v", plan)
+	}
+}
+
+func TestCrawlEventSchedulesUnknownPlaces(t *testing.T) {
+	s := afishatest.NewServer()
+	defer s.Close()
+
+	oldBaseURL := afisha.BaseURL
+	afisha.BaseURL = s.BaseURL()
+	defer func() { afisha.BaseURL = oldBaseURL }()
+
+	outDir = t.TempDir()
+	var err error
+	if units, err = changelog.Open(outDir); err != nil {
+		t.Fatal(err)
+	}
+
+	date := afisha.MakeDate(2019, 6, 1)
+	city := afisha.City{ID: "moscow", Name: "Москва", TimeZone: "Europe/Moscow"}
+	known := afisha.Place{ID: "5575f2a9cc1c725c1f8c6c01", Title: "Пионер", City: city}
+	added := afisha.Place{ID: "5575f2a9cc1c725c1f8c6c02", Title: "Октябрь", City: city}
+	event := afisha.Event{ID: "5c6f0e9a1e2fdb0d1f3c2b01", Title: "Аладдин"}
+
+	for _, pl := range []*afisha.Place{&known, &added} {
+		s.AddScheduleItem(afisha.ScheduleItem{
+			Date: date, Place: pl, Event: &event,
+			Schedule: []afisha.ScheduleSubItem{{Format: "2D", Sessions: []afisha.ScheduleSession{
+				{Date: date, Datetime: "2019-06-01T10:00:00"},
+			}}},
+		})
+	}
+
+	repertory := []afisha.RepertoryItem{{Event: event, ScheduleInfo: afisha.ScheduleInfo{Dates: []afisha.Date{date}}}}
+	places := []placeInfo{{placeID: known.ID, title: known.Title, city: city.ID}}
+	crawlEventSchedules(city.ID, places, repertory, date)
+
+	dir := filepath.Join(outDir, scheduleDir, date.String(), city.ID)
+	if _, err := os.Stat(filepath.Join(dir, known.ID+".json")); err != nil {
+		t.Errorf("Schedule of crawled place isn't saved: %v", err)
+	}
+	// Fill can't save sessions of places it doesn't know
+	if _, err := os.Stat(filepath.Join(dir, added.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("Schedule of place missing in city places is saved: %v", err)
+	}
+}
+
+func TestCrawlEventSchedulesSweep(t *testing.T) {
+	s := afishatest.NewServer()
+	defer s.Close()
+
+	oldBaseURL := afisha.BaseURL
+	afisha.BaseURL = s.BaseURL()
+	defer func() { afisha.BaseURL = oldBaseURL }()
+
+	outDir = t.TempDir()
+
+	date := afisha.MakeDate(2019, 6, 1)
+	city := afisha.City{ID: "moscow", Name: "Москва", TimeZone: "Europe/Moscow"}
+	p1 := afisha.Place{ID: "5575f2a9cc1c725c1f8c6c01", Title: "Пионер", City: city}
+	p2 := afisha.Place{ID: "5575f2a9cc1c725c1f8c6c02", Title: "Октябрь", City: city}
+	ev1 := afisha.Event{ID: "5c6f0e9a1e2fdb0d1f3c2b01", Title: "Аладдин"}
+	ev2 := afisha.Event{ID: "5c6f0e9a1e2fdb0d1f3c2b02", Title: "Годзилла 2"}
+
+	for _, item := range []struct {
+		place *afisha.Place
+		event *afisha.Event
+	}{{&p1, &ev1}, {&p2, &ev2}} {
+		s.AddScheduleItem(afisha.ScheduleItem{
+			Date: date, Place: item.place, Event: item.event,
+			Schedule: []afisha.ScheduleSubItem{{Format: "2D", Sessions: []afisha.ScheduleSession{
+				{Date: date, Datetime: "2019-06-01T10:00:00"},
+			}}},
+		})
+	}
+
+	repertoryItem := func(ev afisha.Event) afisha.RepertoryItem {
+		return afisha.RepertoryItem{Event: ev, ScheduleInfo: afisha.ScheduleInfo{Dates: []afisha.Date{date}}}
+	}
+	places := []placeInfo{{placeID: p1.ID, city: city.ID}, {placeID: p2.ID, city: city.ID}}
+	p2File := filepath.Join(outDir, scheduleDir, date.String(), city.ID, p2.ID+".json")
+
+	crawl := func(repertory ...afisha.RepertoryItem) *changelog.Log {
+		var err error
+		if units, err = changelog.Open(outDir); err != nil {
+			t.Fatal(err)
+		}
+		crawlEventSchedules(city.ID, places, repertory, date)
+		if err := units.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return units.Log()
+	}
+
+	crawl(repertoryItem(ev1), repertoryItem(ev2))
+	if _, err := os.Stat(p2File); err != nil {
+		t.Fatalf("Schedule isn't saved: %v", err)
+	}
+
+	// Schedules aren't removed if some event schedule failed to load
+	s.FailRequests("/api/events/"+ev2.ID, 500, 1)
+	crawl(repertoryItem(ev1), repertoryItem(ev2))
+	if _, err := os.Stat(p2File); err != nil {
+		t.Errorf("Schedule is removed after failed crawl: %v", err)
+	}
+
+	// Second event is gone, so second place has no sessions
+	l := crawl(repertoryItem(ev1))
+	if _, err := os.Stat(p2File); !os.IsNotExist(err) {
+		t.Errorf("Schedule of place without sessions isn't removed: %v", err)
+	}
+	removed := l.Removed("session", scheduleDir)
+	if len(removed) != 1 || removed[0].ID != afisha.ScheduleItemKey(&afisha.ScheduleItem{Date: date, Place: &p2, Event: &ev2}) {
+		t.Errorf("Unexpected removed sessions: %+v", removed)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/metrics"
+	"github.com/stek29/kr/crawler/afisha/util"
+)
+
+const (
+	reportFile = "report.json"
+	reportsDir = "reports"
+)
+
+// Counted kinds of items
+const (
+	kindPlaces   = "places"
+	kindEvents   = "events"
+	kindSessions = "sessions"
+)
+
+var countedKinds = []string{kindPlaces, kindEvents, kindSessions}
+
+// countSessions counts sessions in schedule items
+func countSessions(items []afisha.ScheduleItem) int {
+	n := 0
+	for _, item := range items {
+		for _, sub := range item.Schedule {
+			n += len(sub.Sessions)
+		}
+	}
+	return n
+}
+
+// cityCounts is number of crawled items of every kind in a city
+type cityCounts map[string]int
+
+// runReport is structured report of a crawl run, saved as JSON in out dir
+type runReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Seconds  float64   `json:"seconds"`
+
+	Requests int64            `json:"requests"`
+	Bytes    int64            `json:"bytes"`
+	Retries  int64            `json:"retries"`
+	Errors   map[string]int64 `json:"errors"`
+
+	// Kinds are item kinds crawled in this run, only they are compared
+	Kinds  []string              `json:"kinds"`
+	Cities map[string]cityCounts `json:"cities"`
+
+	Anomalies []string `json:"anomalies"`
+
+	// Error is set if crawl failed, counts of failed crawl aren't compared by later runs
+	Error string `json:"error,omitempty"`
+}
+
+// crawlStats collects runReport during crawl
+type crawlStats struct {
+	requests int64
+	bytes    int64
+	retries  int64
+
+	mu     sync.Mutex
+	report runReport
+	kinds  map[string]struct{}
+}
+
+var stats = newCrawlStats()
+
+func newCrawlStats() *crawlStats {
+	return &crawlStats{
+		report: runReport{
+			Started: time.Now().UTC(),
+			Errors:  map[string]int64{},
+			Cities:  map[string]cityCounts{},
+		},
+		kinds: map[string]struct{}{},
+	}
+}
+
+// target records that items of kind are crawled in city, so city is compared
+// with last counts even if crawl of all its items failed
+func (s *crawlStats) target(city, kind string) {
+	s.count(city, kind, 0)
+}
+
+// count adds n items of kind crawled in city
+func (s *crawlStats) count(city, kind string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.kinds[kind] = struct{}{}
+	counts, ok := s.report.Cities[city]
+	if !ok {
+		counts = cityCounts{}
+		s.report.Cities[city] = counts
+	}
+	counts[kind] += n
+}
+
+// error records error by its type, it's called once per failed request after all retries
+func (s *crawlStats) error(err error) {
+	kind := errorKind(err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report.Errors[kind]++
+}
+
+func (s *crawlStats) retry(err error) {
+	atomic.AddInt64(&s.retries, 1)
+	metrics.Retries.Inc()
+}
+
+// errorKind classifies errors for report
+func errorKind(err error) string {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var statusErr *afisha.StatusError
+
+	switch {
+	case stderrors.Is(err, context.Canceled):
+		return "canceled"
+	case stderrors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case stderrors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case stderrors.As(err, &netErr):
+		return "network"
+	case stderrors.As(err, &statusErr):
+		return fmt.Sprintf("http_%d", statusErr.StatusCode)
+	case stderrors.As(err, &syntaxErr), stderrors.As(err, &typeErr):
+		return "decode"
+	case stderrors.Is(err, afisha.ErrUnexpectedStop):
+		return "paging"
+	default:
+		return "other"
+	}
+}
+
+// countingBody counts bytes read from response body
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+// statsTransport counts requests and response bytes.
+// Failed requests are counted by crawlStats.error once they are out of retries.
+type statsTransport struct {
+	base  http.RoundTripper
+	stats *crawlStats
+}
+
+func (t statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.stats.requests, 1)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = countingBody{resp.Body, &t.stats.bytes}
+	return resp, nil
+}
+
+// client is used for all crawl requests
+var client = &http.Client{
+	Transport: newTransport(http.DefaultTransport),
+}
+
+// newTransport wraps base to collect crawl stats and metrics
+func newTransport(base http.RoundTripper) http.RoundTripper {
+	return statsTransport{metrics.Transport(base), stats}
+}
+
+func loadReport(fn string) (*runReport, error) {
+	var r runReport
+	if err := util.UnmarshalFromFile(fn, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// lastCounts finds counts of cities and kinds targeted by cur in the latest reports in dir which targeted them.
+// Runs usually crawl some of cities and kinds, so the previous report alone doesn't have counts of others.
+// Reports of failed crawls are skipped.
+func lastCounts(dir string, cur *runReport) (map[string]cityCounts, error) {
+	fns, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	// Reports are named by their start time, so newest are last
+	sort.Sort(sort.Reverse(sort.StringSlice(fns)))
+
+	missing := 0
+	for _, counts := range cur.Cities {
+		missing += len(counts)
+	}
+
+	last := map[string]cityCounts{}
+	for _, fn := range fns {
+		if missing == 0 {
+			break
+		}
+
+		r, err := loadReport(fn)
+		if err != nil {
+			slog.Warn("Failed to load report, skipping", "file", fn, "err", err)
+			continue
+		}
+		if r.Error != "" || !r.Started.Before(cur.Started) {
+			continue
+		}
+
+		for city, counts := range cur.Cities {
+			for kind := range counts {
+				n, ok := r.Cities[city][kind]
+				if !ok {
+					continue
+				}
+				if _, ok := last[city][kind]; ok {
+					continue
+				}
+
+				if last[city] == nil {
+					last[city] = cityCounts{}
+				}
+				last[city][kind] = n
+				missing--
+			}
+		}
+	}
+
+	return last, nil
+}
+
+// compareReports returns anomalies of cur compared to last counts: counts dropped by more than threshold (0..1).
+// Only cities and kinds targeted by cur are compared, others weren't crawled by it.
+func compareReports(last map[string]cityCounts, cur *runReport, threshold float64) []string {
+	cities := make([]string, 0, len(cur.Cities))
+	for city := range cur.Cities {
+		cities = append(cities, city)
+	}
+	sort.Strings(cities)
+
+	var anomalies []string
+	for _, city := range cities {
+		for _, kind := range cur.Kinds {
+			now, ok := cur.Cities[city][kind]
+			if !ok {
+				continue
+			}
+
+			was := last[city][kind]
+			if was == 0 || float64(now) >= float64(was)*(1-threshold) {
+				continue
+			}
+
+			anomalies = append(anomalies, fmt.Sprintf(
+				"city %v %v count dropped %.0f%% (%d -> %d)",
+				city, kind, 100*float64(was-now)/float64(was), was, now,
+			))
+		}
+	}
+
+	return anomalies
+}
+
+// finish completes report, crawlErr is error crawl failed with
+func (s *crawlStats) finish(crawlErr error) *runReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.report
+	r.Finished = time.Now().UTC()
+	r.Seconds = r.Finished.Sub(r.Started).Seconds()
+	r.Requests = atomic.LoadInt64(&s.requests)
+	r.Bytes = atomic.LoadInt64(&s.bytes)
+	r.Retries = atomic.LoadInt64(&s.retries)
+
+	r.Kinds = make([]string, 0, len(s.kinds))
+	for _, kind := range countedKinds {
+		if _, ok := s.kinds[kind]; ok {
+			r.Kinds = append(r.Kinds, kind)
+		}
+	}
+
+	if crawlErr != nil {
+		r.Error = crawlErr.Error()
+	}
+
+	return &r
+}
+
+// writeTable prints human readable report
+func (r *runReport) writeTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Duration\t%v\t\n", time.Duration(r.Seconds*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(tw, "Requests\t%d\t\n", r.Requests)
+	fmt.Fprintf(tw, "Bytes\t%d\t\n", r.Bytes)
+	fmt.Fprintf(tw, "Retries\t%d\t\n", r.Retries)
+
+	errorKinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		errorKinds = append(errorKinds, kind)
+	}
+	sort.Strings(errorKinds)
+	for _, kind := range errorKinds {
+		fmt.Fprintf(tw, "Errors (%v)\t%d\t\n", kind, r.Errors[kind])
+	}
+	fmt.Fprintln(tw)
+
+	cities := make([]string, 0, len(r.Cities))
+	for city := range r.Cities {
+		cities = append(cities, city)
+	}
+	sort.Strings(cities)
+
+	fmt.Fprintf(tw, "City\t%v\t\n", strings.Join(countedKinds, "\t"))
+	for _, city := range cities {
+		fmt.Fprintf(tw, "%v", city)
+		for _, kind := range countedKinds {
+			fmt.Fprintf(tw, "\t%d", r.Cities[city][kind])
+		}
+		fmt.Fprintf(tw, "\t\n")
+	}
+
+	tw.Flush()
+
+	for _, a := range r.Anomalies {
+		fmt.Fprintf(w, "ANOMALY: %v\n", a)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "FAILED: %v\n", r.Error)
+	}
+}
+
+// saveReport finishes report, compares it with last counts of reports history,
+// saves it as latest and into reports history, and prints it.
+// Report of failed crawl is saved too, crawlErr is error crawl failed with.
+func saveReport(threshold float64, crawlErr error) error {
+	r := stats.finish(crawlErr)
+
+	// Counts of failed crawl are partial
+	if crawlErr == nil {
+		last, err := lastCounts(path.Join(outDir, reportsDir), r)
+		if err != nil {
+			slog.Warn("Failed to load reports history, skipping comparison", "err", err)
+		}
+		r.Anomalies = compareReports(last, r, threshold)
+		for _, a := range r.Anomalies {
+			slog.Warn("Anomaly", "anomaly", a)
+		}
+	}
+
+	if err := os.MkdirAll(path.Join(outDir, reportsDir), 0755); err != nil {
+		return errors.Wrap(err, "Failed to prepare reports dir")
+	}
+	if err := util.MarshalIntoFile(path.Join(outDir, reportsDir, r.Started.Format("20060102T150405Z")+".json"), r); err != nil {
+		return errors.Wrap(err, "Failed to save report")
+	}
+	if err := util.MarshalIntoFile(path.Join(outDir, reportFile), r); err != nil {
+		return errors.Wrap(err, "Failed to save report")
+	}
+
+	r.writeTable(os.Stderr)
+	return nil
+}
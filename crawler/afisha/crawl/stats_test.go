@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/util"
+)
+
+func TestCompareReports(t *testing.T) {
+	last := map[string]cityCounts{
+		"moscow": {kindPlaces: 100, kindSessions: 1000},
+		"kazan":  {kindPlaces: 10, kindSessions: 100},
+		"abakan": {kindPlaces: 1, kindSessions: 10},
+		"omsk":   {kindPlaces: 5, kindSessions: 50},
+	}
+	// abakan wasn't crawled, omsk was targeted but all its requests failed
+	cur := &runReport{
+		Kinds: []string{kindSessions},
+		Cities: map[string]cityCounts{
+			"moscow": {kindSessions: 200},
+			"kazan":  {kindSessions: 90},
+			"omsk":   {kindSessions: 0},
+		},
+	}
+
+	anomalies := compareReports(last, cur, 0.5)
+	if len(anomalies) != 2 {
+		t.Fatalf("Expected 2 anomalies, got %v", anomalies)
+	}
+	if !strings.Contains(anomalies[0], "moscow sessions count dropped 80% (1000 -> 200)") {
+		t.Errorf("Unexpected anomaly: %v", anomalies[0])
+	}
+	if !strings.Contains(anomalies[1], "omsk sessions count dropped 100% (50 -> 0)") {
+		t.Errorf("Unexpected anomaly: %v", anomalies[1])
+	}
+}
+
+func TestCrawlStats(t *testing.T) {
+	s := newCrawlStats()
+	s.count("moscow", kindPlaces, 3)
+	s.count("moscow", kindPlaces, 2)
+	s.target("omsk", kindSessions)
+	s.error(context.DeadlineExceeded)
+	s.error(&afisha.StatusError{StatusCode: 503})
+	s.retry(nil)
+
+	r := s.finish(nil)
+	if r.Cities["moscow"][kindPlaces] != 5 || r.Errors["timeout"] != 1 || r.Errors["http_503"] != 1 || r.Retries != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+	if n, ok := r.Cities["omsk"][kindSessions]; !ok || n != 0 {
+		t.Errorf("Expected targeted city to be reported, got %+v", r.Cities)
+	}
+	if len(r.Kinds) != 2 || r.Kinds[0] != kindPlaces {
+		t.Errorf("Unexpected kinds: %v", r.Kinds)
+	}
+
+	var buf bytes.Buffer
+	r.writeTable(&buf)
+	if !strings.Contains(buf.String(), "moscow") {
+		t.Errorf("City is missing in table:\n%v", buf.String())
+	}
+}
+
+func TestLastCounts(t *testing.T) {
+	dir := t.TempDir()
+	started := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	save := func(r runReport) {
+		if err := util.MarshalIntoFile(filepath.Join(dir, r.Started.Format("20060102T150405Z")+".json"), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save(runReport{Started: started.Add(-3 * time.Hour), Kinds: []string{kindPlaces, kindSessions}, Cities: map[string]cityCounts{
+		"moscow": {kindPlaces: 100, kindSessions: 1000},
+		"kazan":  {kindPlaces: 10, kindSessions: 100},
+	}})
+	// Newer run only crawled places of moscow
+	save(runReport{Started: started.Add(-2 * time.Hour), Kinds: []string{kindPlaces}, Cities: map[string]cityCounts{
+		"moscow": {kindPlaces: 90},
+	}})
+	// Failed run isn't compared against
+	save(runReport{Started: started.Add(-time.Hour), Error: "stopped", Kinds: []string{kindSessions}, Cities: map[string]cityCounts{
+		"moscow": {kindSessions: 1},
+	}})
+
+	cur := &runReport{Started: started, Kinds: []string{kindPlaces, kindSessions}, Cities: map[string]cityCounts{
+		"moscow": {kindPlaces: 90, kindSessions: 200},
+		"kazan":  {kindSessions: 90},
+		"omsk":   {kindSessions: 10},
+	}}
+
+	last, err := lastCounts(dir, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]cityCounts{
+		"moscow": {kindPlaces: 90, kindSessions: 1000},
+		"kazan":  {kindSessions: 100},
+	}
+	if len(last) != len(want) {
+		t.Errorf("lastCounts() = %v, want %v", last, want)
+	}
+	for city, counts := range want {
+		for kind, n := range counts {
+			if got, ok := last[city][kind]; !ok || got != n {
+				t.Errorf("lastCounts()[%v][%v] = %d, want %d", city, kind, got, n)
+			}
+		}
+	}
+
+	anomalies := compareReports(last, cur, 0.5)
+	if len(anomalies) != 1 || !strings.Contains(anomalies[0], "moscow sessions count dropped 80% (1000 -> 200)") {
+		t.Errorf("Unexpected anomalies: %v", anomalies)
+	}
+}
+
+func TestFailedCrawlReport(t *testing.T) {
+	r := newCrawlStats().finish(errors.New("Failed to load places"))
+	if r.Error != "Failed to load places" {
+		t.Errorf("Expected crawl error to be reported, got %q", r.Error)
+	}
+
+	var buf bytes.Buffer
+	r.writeTable(&buf)
+	if !strings.Contains(buf.String(), "FAILED: Failed to load places") {
+		t.Errorf("Crawl error is missing in table:\n%v", buf.String())
+	}
+}
@@ -0,0 +1,121 @@
+package afisha
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxDateRange limits number of days in a single date range of ParseDates
+const MaxDateRange = 366
+
+// Today returns current local date
+func Today() Date {
+	now := time.Now()
+	return MakeDate(now.Year(), now.Month(), now.Day())
+}
+
+// AddDays returns date n days after d
+func (d Date) AddDays(n int) Date {
+	return Date(time.Time(d).AddDate(0, 0, n))
+}
+
+// Before reports whether d is before other
+func (d Date) Before(other Date) bool {
+	return time.Time(d).Before(time.Time(other))
+}
+
+// parseDateRef parses YYYY-MM-DD, today or today+N
+func parseDateRef(value string, today Date) (Date, error) {
+	if !strings.HasPrefix(value, "today") {
+		return ParseDate(value)
+	}
+
+	rest := strings.TrimPrefix(value, "today")
+	if rest == "" {
+		return today, nil
+	}
+
+	n, err := strconv.Atoi(rest)
+	if err != nil {
+		return Date{}, errors.Errorf("Invalid relative date: `%v`", value)
+	}
+	return today.AddDays(n), nil
+}
+
+// ParseDates parses comma separated list of dates.
+// Every item is one of:
+//
+//	2019-06-01              single date
+//	2019-06-01..2019-06-07  inclusive range, ends might be relative too
+//	today, today-1          single date relative to today
+//	today+7                 today and 7 following days
+//
+// Duplicates are removed, and order of first occurrence is kept.
+func ParseDates(spec string, today Date) ([]Date, error) {
+	var dates []Date
+	seen := map[Date]struct{}{}
+	add := func(d Date) {
+		if _, ok := seen[d]; !ok {
+			seen[d] = struct{}{}
+			dates = append(dates, d)
+		}
+	}
+
+	addRange := func(from, to Date) error {
+		if to.Before(from) {
+			return errors.Errorf("Date range end %v is before start %v", to, from)
+		}
+		if !to.AddDays(-MaxDateRange).Before(from) {
+			return errors.Errorf("Date range %v..%v is longer than %d days", from, to, MaxDateRange)
+		}
+		for d := from; !to.Before(d); d = d.AddDays(1) {
+			add(d)
+		}
+		return nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if parts := strings.SplitN(item, "..", 2); len(parts) == 2 {
+			from, err := parseDateRef(parts[0], today)
+			if err != nil {
+				return nil, err
+			}
+			to, err := parseDateRef(parts[1], today)
+			if err != nil {
+				return nil, err
+			}
+			if err := addRange(from, to); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		d, err := parseDateRef(item, today)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(item, "today+") {
+			if err := addRange(today, d); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		add(d)
+	}
+
+	if len(dates) == 0 {
+		return nil, errors.Errorf("No dates in `%v`", spec)
+	}
+
+	return dates, nil
+}
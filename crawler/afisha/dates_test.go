@@ -0,0 +1,45 @@
+package afisha
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDates(t *testing.T) {
+	today := MakeDate(2019, 6, 1)
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"2019-06-05", []string{"2019-06-05"}},
+		{"2019-06-05,2019-06-03", []string{"2019-06-05", "2019-06-03"}},
+		{"2019-05-30..2019-06-02", []string{"2019-05-30", "2019-05-31", "2019-06-01", "2019-06-02"}},
+		{"today", []string{"2019-06-01"}},
+		{"today-1", []string{"2019-05-31"}},
+		{"today+2", []string{"2019-06-01", "2019-06-02", "2019-06-03"}},
+		{"today..today+1, 2019-06-01", []string{"2019-06-01", "2019-06-02"}},
+	}
+
+	for _, tt := range tests {
+		dates, err := ParseDates(tt.spec, today)
+		if err != nil {
+			t.Errorf("ParseDates(%q) failed: %v", tt.spec, err)
+			continue
+		}
+
+		got := make([]string, len(dates))
+		for i := range dates {
+			got[i] = dates[i].String()
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ParseDates(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"", "tomorrow", "2019-06-02..2019-06-01", "today+x", "2019-01-01..2021-01-01"} {
+		if _, err := ParseDates(spec, today); err == nil {
+			t.Errorf("Expected ParseDates(%q) to fail", spec)
+		}
+	}
+}
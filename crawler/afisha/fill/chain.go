@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/logging"
+)
+
+type ChainLoader struct {
+	Loader
+}
+
+func NewChainLoader(db *sql.DB) *ChainLoader {
+	return &ChainLoader{
+		Loader: *NewLoader(db, LoaderConfig{
+			Table:     "chains",
+			FieldName: "name",
+			FieldID:   "chain_id",
+		}),
+	}
+}
+
+// ChainOverrides fixes chain mis-detections
+type ChainOverrides struct {
+	// Places maps place ya_id to chain name, empty name means no chain
+	Places map[string]string `json:"places"`
+	// Aliases maps detected chain name to correct one, empty name means no chain
+	Aliases map[string]string `json:"aliases"`
+}
+
+// minChainPlaces is minimal number of places sharing title prefix to be considered a chain
+const minChainPlaces = 3
+
+// genericTitleWords are skipped at the beginning of place titles
+var genericTitleWords = map[string]struct{}{
+	"кинотеатр":    {},
+	"кинотеатры":   {},
+	"кинозал":      {},
+	"кинокомплекс": {},
+	"киноцентр":    {},
+	"кинокафе":     {},
+	"мультиплекс":  {},
+	"кино":         {},
+	"к т":          {},
+}
+
+// sharedHosts are hosts links to which don't identify place owner
+var sharedHosts = map[string]struct{}{
+	"vk.com":        {},
+	"ok.ru":         {},
+	"facebook.com":  {},
+	"instagram.com": {},
+	"twitter.com":   {},
+	"youtube.com":   {},
+	"t.me":          {},
+	"kinopoisk.ru":  {},
+	"yandex.ru":     {},
+}
+
+// titlePrefixes returns one and two word prefixes of place title,
+// with generic words like "Кинотеатр" and quotes removed
+func titlePrefixes(title string) []string {
+	words := strings.Fields(strings.NewReplacer("«", " ", "»", " ", "\"", " ").Replace(title))
+
+	for len(words) > 0 {
+		if _, ok := genericTitleWords[normalizeName(words[0])]; !ok {
+			break
+		}
+		words = words[1:]
+	}
+
+	var prefixes []string
+	for i := 1; i <= 2 && i <= len(words); i++ {
+		prefixes = append(prefixes, strings.Join(words[:i], " "))
+	}
+	return prefixes
+}
+
+// linkHosts returns hosts of place links which might identify place owner
+func linkHosts(links []string) []string {
+	var hosts []string
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil || u.Host == "" {
+			continue
+		}
+
+		host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+		if _, ok := sharedHosts[host]; ok {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// mostCommon returns most common non empty string, preferring lexicographically smaller on ties
+func mostCommon(values []string) string {
+	counts := map[string]int{}
+	for _, v := range values {
+		if v != "" {
+			counts[v]++
+		}
+	}
+
+	var best string
+	for v, cnt := range counts {
+		if cnt > counts[best] || (cnt == counts[best] && v < best) {
+			best = v
+		}
+	}
+	return best
+}
+
+// chainPrefix is normalized title prefix of places in city
+type chainPrefix struct {
+	city   string
+	prefix string
+}
+
+// detectChains maps place ya_id to chain name for places which belong to a chain.
+// Places sharing site domain are a chain, otherwise places of same city sharing title prefix are.
+func detectChains(places []afisha.Place, overrides ChainOverrides) map[string]string {
+	// Prefixes are counted per city, so unrelated cinemas with same name
+	// in different cities aren't a chain
+	prefixCount := map[chainPrefix]int{}
+	// normalized prefix => its spellings in titles
+	prefixSpellings := map[string][]string{}
+	placePrefixes := map[string][]string{}
+	placeCity := map[string]string{}
+
+	for _, pl := range places {
+		prefixes := titlePrefixes(pl.Title)
+		placePrefixes[pl.ID] = prefixes
+		placeCity[pl.ID] = pl.City.ID
+
+		for _, prefix := range prefixes {
+			key := normalizeName(prefix)
+			prefixCount[chainPrefix{pl.City.ID, key}]++
+			prefixSpellings[key] = append(prefixSpellings[key], prefix)
+		}
+	}
+
+	// Chain is named by most common spelling, so name doesn't depend on places order
+	prefixName := map[string]string{}
+	for key, spellings := range prefixSpellings {
+		prefixName[key] = mostCommon(spellings)
+	}
+
+	// titleChain picks longest title prefix shared by enough places of same city
+	titleChain := func(placeID string) string {
+		prefixes := placePrefixes[placeID]
+		for i := len(prefixes) - 1; i >= 0; i-- {
+			key := normalizeName(prefixes[i])
+			if prefixCount[chainPrefix{placeCity[placeID], key}] >= minChainPlaces {
+				return prefixName[key]
+			}
+		}
+		return ""
+	}
+
+	hostPlaces := map[string][]string{}
+	for _, pl := range places {
+		for _, host := range linkHosts(pl.Links) {
+			hostPlaces[host] = append(hostPlaces[host], pl.ID)
+		}
+	}
+
+	result := map[string]string{}
+
+	// Iterate hosts in stable order, so place with several hosts gets same chain every time
+	hosts := make([]string, 0, len(hostPlaces))
+	for host := range hostPlaces {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		ids := hostPlaces[host]
+		if len(ids) < 2 {
+			continue
+		}
+
+		names := make([]string, len(ids))
+		for i, id := range ids {
+			names[i] = titleChain(id)
+		}
+
+		name := mostCommon(names)
+		if name == "" {
+			name = host
+		}
+
+		for _, id := range ids {
+			if _, ok := result[id]; !ok {
+				result[id] = name
+			}
+		}
+	}
+
+	for _, pl := range places {
+		if _, ok := result[pl.ID]; ok {
+			continue
+		}
+		if name := titleChain(pl.ID); name != "" {
+			result[pl.ID] = name
+		}
+	}
+
+	for id, name := range result {
+		if alias, ok := overrides.Aliases[name]; ok {
+			result[id] = alias
+		}
+	}
+
+	for id, name := range overrides.Places {
+		result[id] = name
+	}
+
+	for id, name := range result {
+		if name == "" {
+			delete(result, id)
+		}
+	}
+
+	return result
+}
+
+// fillChains detects chains of places and saves them
+func fillChains(db *sql.DB, places []afisha.Place, overrides ChainOverrides) error {
+	placeChains := detectChains(places, overrides)
+
+	chainPlaces := map[string][]string{}
+	var noChain []string
+
+	for _, pl := range places {
+		if name, ok := placeChains[pl.ID]; ok {
+			chainPlaces[name] = append(chainPlaces[name], pl.ID)
+		} else {
+			noChain = append(noChain, pl.ID)
+		}
+	}
+
+	var chains NameData
+	for name := range chainPlaces {
+		chains = append(chains, name)
+	}
+
+	slog.Info("Saving chains", "count", len(chains))
+	chainIDs, err := chainLoader.GetIDsCreating(chains)
+	if err != nil {
+		return err
+	}
+
+	for name, ids := range chainPlaces {
+		chainID, ok := chainIDs[name]
+		if !ok {
+			logging.Fatal("Unexpected chainIDs cache miss", "chain", name)
+		}
+
+		_, err := db.Exec(`UPDATE cinemas SET chain_id = $1 WHERE ya_id = ANY($2)`, chainID, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`UPDATE cinemas SET chain_id = NULL WHERE ya_id = ANY($1)`, pq.Array(noChain))
+	return err
+}
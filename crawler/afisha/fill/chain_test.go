@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stek29/kr/crawler/afisha"
+)
+
+func testPlace(id, city, title string, links ...string) afisha.Place {
+	return afisha.Place{ID: id, City: afisha.City{ID: city}, Title: title, Links: links}
+}
+
+func TestDetectChains(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		places    []afisha.Place
+		overrides ChainOverrides
+		want      map[string]string
+	}{
+		{
+			name: "title prefix in city",
+			places: []afisha.Place{
+				testPlace("1", "moscow", "Кинотеатр «Синема Парк» Мега"),
+				testPlace("2", "moscow", "Синема Парк Ривьера"),
+				testPlace("3", "moscow", "Синема Парк Саларис"),
+				testPlace("4", "moscow", "Пионер"),
+			},
+			want: map[string]string{"1": "Синема Парк", "2": "Синема Парк", "3": "Синема Парк"},
+		},
+		{
+			name: "title prefix across cities",
+			places: []afisha.Place{
+				testPlace("1", "moscow", "Октябрь"),
+				testPlace("2", "kazan", "Октябрь"),
+				testPlace("3", "omsk", "Октябрь"),
+				testPlace("4", "omsk", "Октябрь 2"),
+			},
+			want: map[string]string{},
+		},
+		{
+			name: "site across cities",
+			places: []afisha.Place{
+				testPlace("1", "moscow", "Формула Кино Европа", "https://www.formulakino.ru/europa"),
+				testPlace("2", "moscow", "Формула Кино Горизонт", "https://formulakino.ru/gorizont"),
+				testPlace("3", "moscow", "Формула Кино Арена"),
+				testPlace("4", "kazan", "Формула Кино Тандем", "https://formulakino.ru/tandem"),
+				testPlace("5", "kazan", "Формула Кино Кольцо"),
+			},
+			want: map[string]string{"1": "Формула Кино", "2": "Формула Кино", "3": "Формула Кино", "4": "Формула Кино"},
+		},
+		{
+			name: "site without title prefix",
+			places: []afisha.Place{
+				testPlace("1", "moscow", "Художественный", "http://kinomax.ru/hud", "https://vk.com/hud"),
+				testPlace("2", "kazan", "Мир", "http://kinomax.ru/mir", "https://vk.com/mir"),
+				testPlace("3", "omsk", "Победа", "https://vk.com/pobeda"),
+			},
+			want: map[string]string{"1": "kinomax.ru", "2": "kinomax.ru"},
+		},
+		{
+			name: "most common spelling",
+			places: []afisha.Place{
+				testPlace("1", "moscow", "КАРО 11 Октябрь"),
+				testPlace("2", "moscow", "Каро Атриум"),
+				testPlace("3", "moscow", "Каро Варшавский"),
+			},
+			want: map[string]string{"1": "Каро", "2": "Каро", "3": "Каро"},
+		},
+		{
+			name: "overrides",
+			places: []afisha.Place{
+				testPlace("1", "moscow", "Люксор Ереван Плаза"),
+				testPlace("2", "moscow", "Люксор Калейдоскоп"),
+				testPlace("3", "moscow", "Люксор Vegas"),
+				testPlace("4", "moscow", "Иллюзион"),
+			},
+			overrides: ChainOverrides{
+				Places:  map[string]string{"3": "", "4": "Госфильмофонд"},
+				Aliases: map[string]string{"Люксор": "Luxor"},
+			},
+			want: map[string]string{"1": "Luxor", "2": "Luxor", "4": "Госфильмофонд"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := detectChains(c.places, c.overrides); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("detectChains() = %v, want %v", got, c.want)
+			}
+
+			// Result must not depend on places order
+			reversed := make([]afisha.Place, len(c.places))
+			for i, pl := range c.places {
+				reversed[len(c.places)-1-i] = pl
+			}
+			if got := detectChains(reversed, c.overrides); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("detectChains() of reversed places = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+
+	"github.com/stek29/kr/crawler/afisha/changelog"
+)
+
+// changes is change log of crawls since units were acknowledged, only changed units are filled if it's set
+var changes *changelog.Log
+
+// filledUnits are changed units whose rows were committed, they are acknowledged once fill succeeds
+var filledUnits []string
+
+// changedFiles filters files in outDir down to units changed since they were last filled
+func changedFiles(files []string) []string {
+	if changes == nil {
+		return files
+	}
+
+	var res []string
+	for _, fn := range files {
+		rel, err := filepath.Rel(outDir, fn)
+		if err != nil {
+			slog.Warn("Unexpected file outside of out dir", "file", fn, "err", err)
+			continue
+		}
+
+		if changes.UnitChanged(rel) {
+			res = append(res, fn)
+		}
+	}
+
+	slog.Info("Filtered files changed since last fill", "changed", len(res), "total", len(files))
+	return res
+}
+
+// markFilled records files in outDir as filled once their rows are committed.
+// Files skipped by fill must not be marked, so they are filled again by next run.
+func markFilled(files []string) {
+	if changes == nil {
+		return
+	}
+
+	for _, fn := range files {
+		rel, err := filepath.Rel(outDir, fn)
+		if err != nil {
+			slog.Warn("Unexpected file outside of out dir", "file", fn, "err", err)
+			continue
+		}
+		filledUnits = append(filledUnits, rel)
+	}
+}
+
+// removedItems returns items of kind in units under dir relative to outDir which crawl no longer produces
+func removedItems(kind, dir string) []changelog.Change {
+	if changes == nil {
+		return nil
+	}
+	return changes.Removed(kind, dir)
+}
+
+// acknowledgeChanges records filled units in change log, so they aren't filled again until next change
+func acknowledgeChanges() error {
+	if changes == nil {
+		return nil
+	}
+
+	if err := changelog.Acknowledge(outDir, changes, filledUnits); err != nil {
+		return err
+	}
+	slog.Info("Acknowledged filled units", "count", len(filledUnits))
+	return nil
+}
@@ -2,8 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"log/slog"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/util"
 )
 
+const citiesFile = "cities.json"
+
 type CityLoader struct {
 	Loader
 }
@@ -22,17 +30,18 @@ type CityDataItem struct {
 	CountryCode [2]byte
 	Name        string
 	YaName      string
+	GeoID       int
 	TimeZoneID  int
 }
 
 type CityData []CityDataItem
 
 func (CityData) Fields() []string {
-	return []string{"country_code", "name", "ya_name", "timezone_id"}
+	return []string{"country_code", "name", "ya_name", "geo_id", "timezone_id"}
 }
 
 func (CityData) InsertFormat() (string, int) {
-	return "$%d, $%d, $%d, $%d", 4
+	return "$%d, $%d, $%d, $%d, $%d", 5
 }
 
 func (d CityData) Names() []string {
@@ -51,15 +60,102 @@ func (d CityData) Values(filter map[string]struct{}) []interface{} {
 			continue
 		}
 
-		var idata [4]interface{}
+		var idata [5]interface{}
 
 		idata[0] = string(item.CountryCode[:])
 		idata[1] = item.Name
 		idata[2] = item.YaName
-		idata[3] = item.TimeZoneID
+		idata[3] = sql.NullInt64{Int64: int64(item.GeoID), Valid: item.GeoID != 0}
+		idata[4] = item.TimeZoneID
 
 		res = append(res, idata[:]...)
 	}
 
 	return res
 }
+
+// saveCities creates missing cities and returns their IDs by Afisha IDs.
+// If update is set, names, geoids and timezones of existing cities are updated too.
+func saveCities(db *sql.DB, cities []afisha.City, update bool) (map[string]int, error) {
+	tzset := map[string]struct{}{}
+	for _, city := range cities {
+		tzset[city.TimeZone] = struct{}{}
+	}
+
+	tzs := make([]string, 0, len(tzset))
+	for tz := range tzset {
+		tzs = append(tzs, tz)
+	}
+
+	tzmap, err := tzLoader.GetIDs(tzs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tzmap) < len(tzs) {
+		slog.Error("Some timezones are missing", "expected", len(tzs), "got", len(tzmap))
+		for _, tz := range tzs {
+			if _, ok := tzmap[tz]; !ok {
+				slog.Error("Timezone is missing", "timezone", tz)
+			}
+		}
+		return nil, errors.Errorf("Cant find some timezones")
+	}
+
+	slog.Info("Loaded timezones", "count", len(tzmap))
+
+	data := make(CityData, len(cities))
+	for i, city := range cities {
+		var ok bool
+
+		data[i].CountryCode = [...]byte{'R', 'U'}
+		data[i].Name = city.Name
+		data[i].YaName = city.ID
+		data[i].GeoID = city.GeoID
+		data[i].TimeZoneID, ok = tzmap[city.TimeZone]
+		if !ok {
+			panic(errors.Errorf("Unexpected cache miss for tz: %v", city.TimeZone))
+		}
+	}
+
+	slog.Info("Saving cities", "count", len(data))
+	cityIDmap, err := cityLoader.GetIDsCreating(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !update {
+		return cityIDmap, nil
+	}
+
+	updated := 0
+	for _, item := range data {
+		res, err := db.Exec(`
+			UPDATE cities SET name = $2, geo_id = $3, timezone_id = $4
+			WHERE ya_name = $1 AND (name, geo_id, timezone_id) IS DISTINCT FROM ($2, $3, $4)`,
+			item.YaName, item.Name, sql.NullInt64{Int64: int64(item.GeoID), Valid: item.GeoID != 0}, item.TimeZoneID,
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to update city %v", item.YaName)
+		}
+
+		if n, err := res.RowsAffected(); err == nil {
+			updated += int(n)
+		}
+	}
+	slog.Info("Updated cities", "count", updated)
+
+	return cityIDmap, nil
+}
+
+// fillCities saves cities crawled with crawl -do-cities
+func fillCities(db *sql.DB) error {
+	var cities []afisha.City
+	if err := util.UnmarshalFromFile(path.Join(outDir, citiesFile), &cities); err != nil {
+		return errors.Wrap(err, "Failed to load cities")
+	}
+	slog.Info("Loaded cities", "count", len(cities))
+
+	_, err := saveCities(db, cities, true)
+	return err
+}
@@ -1,19 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/PuerkitoBio/goquery"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/stek29/kr/crawler/afisha"
 	"github.com/stek29/kr/crawler/afisha/util"
@@ -21,6 +19,7 @@ import (
 
 type EventLoader struct {
 	Loader
+	aliases *Loader
 }
 
 func NewEventLoader(db *sql.DB) *EventLoader {
@@ -30,7 +29,38 @@ func NewEventLoader(db *sql.DB) *EventLoader {
 			FieldName: "ya_event_id",
 			FieldID:   "movie_id",
 		}),
+		aliases: NewLoader(db, LoaderConfig{
+			Table:     "event_aliases",
+			FieldName: "ya_event_id",
+			FieldID:   "movie_id",
+		}),
+	}
+}
+
+// GetIDs is Loader.GetIDs which respects event aliases of merged movies
+func (l *EventLoader) GetIDs(names []string) (map[string]int, error) {
+	result, err := l.aliases.GetIDs(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var rest []string
+	for _, name := range names {
+		if _, ok := result[name]; !ok {
+			rest = append(rest, name)
+		}
+	}
+
+	found, err := l.Loader.GetIDs(rest)
+	if err != nil {
+		return nil, err
 	}
+
+	for name, id := range found {
+		result[name] = id
+	}
+
+	return result, nil
 }
 
 type EventDataItem struct {
@@ -44,16 +74,74 @@ type EventDataItem struct {
 	AgeRestriction int
 	CountryCode    string
 	KpRating       int
+	Description    string
+
+	Genres []string
+	Images afisha.Image
+
+	// Countries are country names as seen on afisha
+	Countries []string
+	// CountryCodes are resolved Countries
+	CountryCodes []string
+	People       []EventPerson
+}
+
+// HasDetails reports if item has all details usually missing in repertory
+func (item *EventDataItem) HasDetails() bool {
+	return item.Year != 0 && item.Duration != 0 && !item.Release.IsZero() && item.AgeRestriction != 0
+}
+
+// Merge fills empty fields of item from other
+func (item *EventDataItem) Merge(other *EventDataItem) {
+	if item.KpID == 0 {
+		item.KpID = other.KpID
+	}
+	if item.TitleRU == "" {
+		item.TitleRU = other.TitleRU
+	}
+	if item.TitleOR == "" {
+		item.TitleOR = other.TitleOR
+	}
+	if item.Year == 0 {
+		item.Year = other.Year
+	}
+	if item.Duration == 0 {
+		item.Duration = other.Duration
+	}
+	if item.Release.IsZero() {
+		item.Release = other.Release
+	}
+	if item.AgeRestriction == 0 {
+		item.AgeRestriction = other.AgeRestriction
+	}
+	if item.KpRating == 0 {
+		item.KpRating = other.KpRating
+	}
+	if item.Description == "" {
+		item.Description = other.Description
+	}
+	if len(item.Genres) == 0 {
+		item.Genres = other.Genres
+	}
+	if len(item.Images) == 0 {
+		item.Images = other.Images
+	}
+	if len(item.Countries) == 0 {
+		item.Countries = other.Countries
+	}
+	if len(item.People) == 0 {
+		item.People = other.People
+	}
 }
 
 type EventData []EventDataItem
 
 func (EventData) Fields() []string {
-	return []string{"ya_event_id", "kp_id", "title_ru", "title_or", "year", "duration", "release", "age_restriction", "country_code", "kp_rating"}
+	return []string{"ya_event_id", "kp_id", "title_ru", "title_or", "year", "duration", "release", "age_restriction", "country_code", "kp_rating", "description"}
 }
 
 func (EventData) InsertFormat() (string, int) {
-	return "$%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d", 10
+	return "$%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d", 11
 }
 
 func (d EventData) Names() []string {
@@ -72,7 +160,7 @@ func (d EventData) Values(filter map[string]struct{}) []interface{} {
 			continue
 		}
 
-		var idata [10]interface{}
+		var idata [11]interface{}
 
 		idata[0] = item.EventID
 		if item.KpID != 0 {
@@ -102,6 +190,9 @@ func (d EventData) Values(filter map[string]struct{}) []interface{} {
 		if item.KpRating != 0 {
 			idata[9] = item.KpRating
 		}
+		if item.Description != "" {
+			idata[10] = item.Description
+		}
 
 		res = append(res, idata[:]...)
 	}
@@ -109,71 +200,43 @@ func (d EventData) Values(filter map[string]struct{}) []interface{} {
 	return res
 }
 
-var ruMonths = []struct {
-	match string
-	val   time.Month
-}{
-	{"январ", time.January},
-	{"феврал", time.February},
-	{"март", time.March},
-	{"апрел", time.April},
-	{"июн", time.June},
-	{"июл", time.July},
-	{"август", time.August},
-	{"сентябр", time.September},
-	{"октябр", time.October},
-	{"ноябр", time.November},
-	{"декабр", time.December},
-	{"ма", time.May},
-}
-
-func parseRUDate(value string) (afisha.Date, error) {
-	dateParts := strings.SplitN(value, " ", 3)
-	if len(dateParts) != 3 {
-		return afisha.Date{}, errors.New("Cant split in 3 parts")
-	}
-
-	day, err := strconv.Atoi(dateParts[0])
-	if err != nil {
-		return afisha.Date{}, errors.Wrapf(err, "Failed to parse day %s", dateParts[0])
-	}
-
-	year, err := strconv.Atoi(dateParts[2])
-	if err != nil {
-		return afisha.Date{}, errors.Wrapf(err, "Failed to parse year %s", dateParts[2])
-	}
-
-	var month time.Month
-	monthStr := dateParts[1]
-	matched := false
-
-	for _, def := range ruMonths {
-		if strings.Contains(monthStr, def.match) {
-			month = def.val
-			matched = true
-		}
-	}
+var eventPageSelectors = DefaultEventPageSelectors
+
+// applyEventDetails fills item from API event details
+func applyEventDetails(item *EventDataItem, details *afisha.EventDetails) {
+	item.Merge(&EventDataItem{
+		KpID:           kpIDFromURL(details.Kinopoisk.URL),
+		KpRating:       int(details.Kinopoisk.Value * 10),
+		TitleRU:        details.Title,
+		TitleOR:        details.OriginalTitle,
+		Year:           details.Year,
+		Duration:       details.Duration,
+		Release:        details.DateReleased,
+		AgeRestriction: parseAgeRestriction(details.ContentRating),
+		Description:    details.Description,
+		Images:         details.Image,
+	})
 
-	if !matched {
-		return afisha.Date{}, errors.Errorf("Failed to parse month %s", monthStr)
+	for _, genre := range details.Genres {
+		item.Genres = append(item.Genres, string(genre))
 	}
-
-	return afisha.MakeDate(year, month, day), nil
 }
 
-var durationRegexp = regexp.MustCompile(`(\d+) мин.`)
-
-var kpRegexp = regexp.MustCompile(`kinopoisk.ru/film/(\d+)`)
+// parseAgeRestriction parses age restriction like "16+"
+func parseAgeRestriction(value string) int {
+	age, _ := strconv.Atoi(strings.Trim(value, "+ "))
+	return age
+}
 
-func fetchAfisha(evID, afishaURL string) (*EventDataItem, error) {
-	req, err := http.NewRequest("GET", "https://afisha.yandex.ru/"+afishaURL, nil)
+func fetchAfisha(evID, afishaURL string, health *ParserHealth) (*EventDataItem, error) {
+	req, err := http.NewRequest("GET", afisha.BaseURL+afishaURL, nil)
 	if err != nil {
 		return nil, err
 	}
 	// fuck captcha
 	req.Header.Set("Cookie", "bltsr=1")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := afishaClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -191,73 +254,7 @@ func fetchAfisha(evID, afishaURL string) (*EventDataItem, error) {
 		return nil, errors.New("CAPTCHA")
 	}
 
-	var item EventDataItem
-
-	item.EventID = evID
-
-	{
-		match := kpRegexp.FindSubmatch(data)
-		if len(match) == 2 {
-			kpID, err := strconv.Atoi(string(match[1]))
-			if err == nil {
-				item.KpID = kpID
-			}
-		}
-	}
-
-	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
-	if err != nil {
-		return nil, err
-	}
-
-	getText := func(sel *goquery.Selection, selector string) string {
-		sel = sel.Find(selector)
-		if sel == nil {
-			return ""
-		}
-		return strings.TrimSpace(sel.Text())
-	}
-
-	item.AgeRestriction, _ = strconv.Atoi(strings.Trim(getText(doc.Selection, `[class=event-heading__content-rating]`), "+"))
-	kpRate, err := strconv.ParseFloat(getText(doc.Selection, `[class="arrow__text"]`), 32)
-	if err == nil {
-		item.KpRating = int(kpRate * 100)
-	}
-	item.TitleRU = getText(doc.Selection, `[class="event-heading__title"]`)
-
-	doc.Find(`[class="event-attributes__row"]`).Each(func(_ int, sel *goquery.Selection) {
-		key := getText(sel, `[class="event-attributes__category"]`)
-		value := getText(sel, `[class="event-attributes__category-value"]`)
-
-		switch key {
-		case "Оригинальное название":
-			item.TitleOR = value
-		case "Год производства":
-			item.Year, _ = strconv.Atoi(value)
-		case "Время":
-			match := durationRegexp.FindSubmatch([]byte(value))
-			if len(match) != 2 {
-				log.Printf("Failed to parse (%v: %v): durationRegexp didn't match", key, value)
-				break
-			}
-
-			item.Duration, _ = strconv.Atoi(string(match[1]))
-		case "Страна":
-			// item.CountryCode
-		case "Премьера":
-			item.Release, err = parseRUDate(value)
-			if err != nil {
-				log.Printf("Failed to parse (%v: %v): %v", key, value, err)
-			}
-
-		case "Режиссёр", "Продюсер", "Композитор", "В ролях":
-
-		default:
-			log.Printf("Unknown category: %v", key)
-		}
-	})
-
-	return &item, nil
+	return parseEventPage(evID, data, eventPageSelectors, health)
 }
 
 type yaEventInfo struct {
@@ -266,6 +263,7 @@ type yaEventInfo struct {
 	url           string
 	title         string
 	originalTitle string
+	image         afisha.Image
 }
 
 // loadRepertoryInfo loads evID=>info from repertories
@@ -274,7 +272,7 @@ func loadRepertoryInfo() (map[string]yaEventInfo, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Repertory files Glob failed: ")
 	}
-	log.Printf("Loading repertories from %d files", len(repertoryFiles))
+	slog.Info("Loading repertories", "files", len(repertoryFiles))
 
 	result := map[string]yaEventInfo{}
 
@@ -282,7 +280,7 @@ func loadRepertoryInfo() (map[string]yaEventInfo, error) {
 		var items []afisha.RepertoryItem
 		err := util.UnmarshalFromFile(fn, &items)
 		if err != nil {
-			log.Printf("Failed to load file %v, skipping: %v", fn, err)
+			slog.Warn("Failed to load repertory file, skipping", "file", fn, "err", err)
 			continue
 		}
 
@@ -301,6 +299,7 @@ func loadRepertoryInfo() (map[string]yaEventInfo, error) {
 				title:         event.Title,
 				originalTitle: event.OriginalTitle,
 				url:           event.URL,
+				image:         event.Image,
 			}
 		}
 	}
@@ -308,9 +307,9 @@ func loadRepertoryInfo() (map[string]yaEventInfo, error) {
 	return result, nil
 }
 
-func loadEvents(events map[string]yaEventInfo) (map[string]int, error) {
+func loadEvents(db *sql.DB, events map[string]yaEventInfo) (map[string]int, error) {
 	var err error
-	log.Printf("Found %d events", len(events))
+	slog.Info("Found events", "count", len(events))
 
 	names := make([]string, len(events))
 	i := 0
@@ -336,63 +335,210 @@ func loadEvents(events map[string]yaEventInfo) (map[string]int, error) {
 	}
 
 	var createEvents EventData
+	var health ParserHealth
 
 	for evID, info := range events {
 		if _, ok := result[evID]; ok {
 			continue
 		}
 
-		item := EventDataItem{
-			EventID:  evID,
-			KpID:     info.kpID,
-			KpRating: info.kpRate,
-			TitleRU:  info.title,
-			TitleOR:  info.originalTitle,
+		createEvents = append(createEvents, fetchEvent(evID, info, &health))
+	}
+
+	if backfillEvents {
+		if err := backfillSavedEvents(db, events, result, &health); err != nil {
+			return nil, errors.Wrap(err, "Failed to backfill events")
+		}
+	}
+
+	health.Log()
+
+	if len(createEvents) == 0 {
+		return result, err
+	}
+
+	if err := resolveCountries(createEvents); err != nil {
+		return nil, err
+	}
+
+	created, err := eventLoader.GetIDsCreating(createEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fillEventRelations(db, createEvents, created); err != nil {
+		return nil, errors.Wrap(err, "Failed to save event relations")
+	}
+
+	for name, id := range created {
+		result[name] = id
+	}
+
+	return result, err
+}
+
+// fetchEvent makes event item from repertory info, API event details and event page.
+// Event page parse results are recorded to health.
+func fetchEvent(evID string, info yaEventInfo, health *ParserHealth) EventDataItem {
+	item := EventDataItem{
+		EventID:  evID,
+		KpID:     info.kpID,
+		KpRating: info.kpRate,
+		TitleRU:  info.title,
+		TitleOR:  info.originalTitle,
+		Images:   info.image,
+	}
+
+	details, err := afisha.GetEvent(context.Background(), afishaClient, evID)
+	if err != nil {
+		slog.Warn("Failed to get event, falling back to page", "event", evID, "err", err)
+	} else {
+		applyEventDetails(&item, details)
+		if info.url == "" {
+			info.url = details.URL
 		}
+	}
 
-		afItem, err := fetchAfisha(evID, info.url)
+	if err != nil || !item.HasDetails() {
+		afItem, err := fetchAfisha(evID, info.url, health)
 		if err != nil {
-			log.Printf("Failed to fetchAfisha (event=%s): %v", evID, err)
-			createEvents = append(createEvents, item)
-			continue
+			slog.Warn("Failed to fetch event page", "event", evID, "err", err)
+		} else {
+			item.Merge(afItem)
 		}
+	}
 
-		if afItem.KpID != 0 {
-			info.kpID = afItem.KpID
-		} else {
-			afItem.KpID = info.kpID
+	return item
+}
+
+// resolveCountries sets country codes of events by their country names
+func resolveCountries(events EventData) error {
+	for i := range events {
+		codes, err := countryLoader.GetCodes(events[i].Countries)
+		if err != nil {
+			return errors.Wrap(err, "Failed to resolve countries")
 		}
-		if afItem.TitleRU != "" {
-			info.title = afItem.TitleRU
-		} else {
-			afItem.TitleRU = info.title
+
+		events[i].CountryCodes = codes
+		if len(codes) != 0 {
+			events[i].CountryCode = codes[0]
 		}
+	}
+	return nil
+}
 
-		if afItem.TitleOR != "" {
-			info.originalTitle = afItem.TitleOR
-		} else {
-			afItem.TitleOR = info.originalTitle
+// backfilledEvents are events already backfilled in this run, since events are loaded for each date
+var backfilledEvents = map[string]struct{}{}
+
+// backfillSavedEvents fetches details of already saved movies which have
+// no people, countries, genres or images, or no description, age restriction or duration,
+// and saves them. Such movies were created before these details were filled.
+func backfillSavedEvents(db *sql.DB, events map[string]yaEventInfo, movieIDs map[string]int, health *ParserHealth) error {
+	var ids []int
+	for evID, id := range movieIDs {
+		if _, ok := backfilledEvents[evID]; !ok {
+			ids = append(ids, id)
 		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
 
-		// Save info in case we ever need it
-		events[evID] = info
-		createEvents = append(createEvents, *afItem)
+	rows, err := db.Query(`
+		SELECT movie_id FROM movies m
+		WHERE movie_id = ANY($1) AND (
+			NOT EXISTS(SELECT 1 FROM movie_people r WHERE r.movie_id = m.movie_id) OR
+			NOT EXISTS(SELECT 1 FROM movie_countries r WHERE r.movie_id = m.movie_id) OR
+			NOT EXISTS(SELECT 1 FROM movie_genres r WHERE r.movie_id = m.movie_id) OR
+			NOT EXISTS(SELECT 1 FROM movie_images r WHERE r.movie_id = m.movie_id) OR
+			m.description IS NULL OR m.age_restriction IS NULL OR m.duration IS NULL
+		)`, pq.Array(ids))
+	if err != nil {
+		return err
 	}
 
-	if len(createEvents) == 0 {
-		return result, err
+	incomplete := map[int]struct{}{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		incomplete[id] = struct{}{}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	created, err := eventLoader.GetIDsCreating(createEvents)
+	var backfill EventData
+	for evID, id := range movieIDs {
+		if _, ok := incomplete[id]; !ok {
+			continue
+		}
+		if _, ok := backfilledEvents[evID]; ok {
+			continue
+		}
+		backfilledEvents[evID] = struct{}{}
+		backfill = append(backfill, fetchEvent(evID, events[evID], health))
+	}
+
+	slog.Info("Backfilling events", "count", len(backfill))
+	if len(backfill) == 0 {
+		return nil
+	}
+
+	if err := resolveCountries(backfill); err != nil {
+		return err
+	}
+
+	if err := updateEventDetails(db, backfill, movieIDs); err != nil {
+		return errors.Wrap(err, "Failed to update movie details")
+	}
+
+	return fillEventRelations(db, backfill, movieIDs)
+}
+
+// updateEventDetails sets details of saved movies which are still unknown
+func updateEventDetails(db *sql.DB, events EventData, movieIDs map[string]int) error {
+	txn, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer txn.Rollback()
+
+	stmt, err := txn.Prepare(`
+		UPDATE movies
+		SET description = COALESCE(description, $2),
+		    age_restriction = COALESCE(age_restriction, $3),
+		    duration = COALESCE(duration, $4)
+		WHERE movie_id = $1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
 
-	for name, id := range created {
-		result[name] = id
+	for _, ev := range events {
+		var description, ageRestriction, duration interface{}
+		if ev.Description != "" {
+			description = ev.Description
+		}
+		if ev.AgeRestriction != 0 {
+			ageRestriction = ev.AgeRestriction
+		}
+		if ev.Duration != 0 {
+			duration = ev.Duration
+		}
+		if description == nil && ageRestriction == nil && duration == nil {
+			continue
+		}
+
+		if _, err := stmt.Exec(movieIDs[ev.EventID], description, ageRestriction, duration); err != nil {
+			return err
+		}
 	}
 
-	return result, err
+	return txn.Commit()
 }
 
 func kpIDFromURL(url string) int {
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/rudate"
+)
+
+// EventPageSelectors are CSS selectors used to scrape event page when JSON-LD is missing or incomplete
+type EventPageSelectors struct {
+	Title          string `json:"title"`
+	AgeRestriction string `json:"age_restriction"`
+	KpRating       string `json:"kp_rating"`
+	AttributeRow   string `json:"attribute_row"`
+	AttributeName  string `json:"attribute_name"`
+	AttributeValue string `json:"attribute_value"`
+}
+
+// DefaultEventPageSelectors match afisha markup at the time of writing
+var DefaultEventPageSelectors = EventPageSelectors{
+	Title:          `[class="event-heading__title"]`,
+	AgeRestriction: `[class=event-heading__content-rating]`,
+	KpRating:       `[class="arrow__text"]`,
+	AttributeRow:   `[class="event-attributes__row"]`,
+	AttributeName:  `[class="event-attributes__category"]`,
+	AttributeValue: `[class="event-attributes__category-value"]`,
+}
+
+// Event page fields tracked by parser health report
+const (
+	fieldTitleRU        = "title_ru"
+	fieldTitleOR        = "title_or"
+	fieldYear           = "year"
+	fieldDuration       = "duration"
+	fieldRelease        = "release"
+	fieldAgeRestriction = "age_restriction"
+	fieldKpRating       = "kp_rating"
+	fieldKpID           = "kp_id"
+	fieldCountries      = "countries"
+	fieldPeople         = "people"
+)
+
+// missingFields lists fields of item which weren't extracted
+func missingFields(item *EventDataItem) []string {
+	var missing []string
+	check := func(field string, ok bool) {
+		if !ok {
+			missing = append(missing, field)
+		}
+	}
+
+	check(fieldTitleRU, item.TitleRU != "")
+	check(fieldTitleOR, item.TitleOR != "")
+	check(fieldYear, item.Year != 0)
+	check(fieldDuration, item.Duration != 0)
+	check(fieldRelease, !item.Release.IsZero())
+	check(fieldAgeRestriction, item.AgeRestriction != 0)
+	check(fieldKpRating, item.KpRating != 0)
+	check(fieldKpID, item.KpID != 0)
+	check(fieldCountries, len(item.Countries) != 0)
+	check(fieldPeople, len(item.People) != 0)
+
+	return missing
+}
+
+// Sources of event page data besides markup, counted by parser health report
+const (
+	sourceJSONLD       = "json_ld"
+	sourceInitialState = "initial_state"
+)
+
+// ParserHealth counts fields which failed to extract from event pages.
+// It's filled by parseEventPage and logged by caller once pages are parsed.
+type ParserHealth struct {
+	mu      sync.Mutex
+	pages   int
+	sources map[string]int
+	failed  map[string]int
+}
+
+// Record adds page parse result to the report, sources are data sources found on the page
+func (h *ParserHealth) Record(missing []string, sources []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failed == nil {
+		h.failed = map[string]int{}
+		h.sources = map[string]int{}
+	}
+
+	h.pages++
+	for _, source := range sources {
+		h.sources[source]++
+	}
+	for _, field := range missing {
+		h.failed[field]++
+	}
+}
+
+// Log writes the report to log
+func (h *ParserHealth) Log() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pages == 0 {
+		return
+	}
+
+	slog.Info("Event page parser health", "pages", h.pages,
+		sourceJSONLD, h.sources[sourceJSONLD], sourceInitialState, h.sources[sourceInitialState])
+
+	fields := make([]string, 0, len(h.failed))
+	for field := range h.failed {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		slog.Warn("Event page parser failed to extract field", "field", field, "failed", h.failed[field], "pages", h.pages)
+	}
+}
+
+// ldPeople is schema.org Person, Country or Organization or list of them
+type ldPeople []string
+
+// UnmarshalJSON conforms to json.Unmarshaler
+func (p *ldPeople) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		items = []json.RawMessage{data}
+	}
+
+	*p = nil
+	for _, raw := range items {
+		var name string
+		if err := json.Unmarshal(raw, &name); err != nil {
+			var named struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(raw, &named); err != nil {
+				return err
+			}
+			name = named.Name
+		}
+
+		if name = strings.TrimSpace(name); name != "" {
+			*p = append(*p, name)
+		}
+	}
+
+	return nil
+}
+
+// ldMovie is schema.org Movie
+type ldMovie struct {
+	Type            json.RawMessage `json:"@type"`
+	Name            string          `json:"name"`
+	AlternateName   string          `json:"alternateName"`
+	DateCreated     string          `json:"dateCreated"`
+	DatePublished   string          `json:"datePublished"`
+	Duration        string          `json:"duration"`
+	ContentRating   string          `json:"contentRating"`
+	Director        ldPeople        `json:"director"`
+	Producer        ldPeople        `json:"producer"`
+	MusicBy         ldPeople        `json:"musicBy"`
+	Actor           ldPeople        `json:"actor"`
+	CountryOfOrigin ldPeople        `json:"countryOfOrigin"`
+
+	WorkPresented *ldMovie          `json:"workPresented"`
+	Graph         []json.RawMessage `json:"@graph"`
+}
+
+func (m *ldMovie) isMovie() bool {
+	return bytes.Contains(m.Type, []byte(`"Movie"`))
+}
+
+// findLDMovie looks for Movie in JSON-LD document, which might be list, @graph or ScreeningEvent
+func findLDMovie(data []byte) *ldMovie {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		items = []json.RawMessage{data}
+	}
+
+	for _, raw := range items {
+		var m ldMovie
+		if err := json.Unmarshal(raw, &m); err != nil {
+			continue
+		}
+
+		switch {
+		case m.isMovie():
+			return &m
+		case m.WorkPresented != nil && m.WorkPresented.isMovie():
+			return m.WorkPresented
+		}
+
+		for _, node := range m.Graph {
+			if found := findLDMovie(node); found != nil {
+				return found
+			}
+		}
+	}
+
+	return nil
+}
+
+// initialStateRegexp matches assignment of state embedded into page script,
+// like window.__INITIAL_STATE__ = {...};
+var initialStateRegexp = regexp.MustCompile(`(?:window\.)?__INITIAL_STATE__\s*=\s*`)
+
+// findStateEvent looks for event evID in state embedded into page script.
+// Event is an object with evID as its id anywhere in the state, shaped like API event details.
+func findStateEvent(doc *goquery.Document, evID string) *afisha.EventDetails {
+	var found *afisha.EventDetails
+
+	doc.Find("script").EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		text := s.Text()
+		loc := initialStateRegexp.FindStringIndex(text)
+		if loc == nil {
+			return true
+		}
+
+		// Decoder stops after state object, ignoring rest of the script
+		var state interface{}
+		if err := json.NewDecoder(strings.NewReader(text[loc[1]:])).Decode(&state); err != nil {
+			slog.Debug("Failed to decode event page initial state", "event", evID, "err", err)
+			return true
+		}
+
+		node := findStateNode(state, evID)
+		if node == nil {
+			return true
+		}
+
+		data, err := json.Marshal(node)
+		if err != nil {
+			return true
+		}
+
+		var ev afisha.EventDetails
+		if err := json.Unmarshal(data, &ev); err != nil {
+			slog.Debug("Failed to decode event from page initial state", "event", evID, "err", err)
+			return true
+		}
+
+		found = &ev
+		return false
+	})
+
+	return found
+}
+
+// findStateNode finds object with id and title in decoded JSON
+func findStateNode(node interface{}, id string) map[string]interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if v["id"] == id {
+			if _, ok := v["title"]; ok {
+				return v
+			}
+		}
+
+		// Keys are sorted, so same node is found every time
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if found := findStateNode(v[key], id); found != nil {
+				return found
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if found := findStateNode(item, id); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// applyStateEvent fills empty fields of item from event in page initial state.
+// Kinopoisk id is taken from page links, like for other sources.
+func applyStateEvent(item *EventDataItem, ev *afisha.EventDetails) {
+	item.Merge(&EventDataItem{
+		KpRating:       int(ev.Kinopoisk.Value * 10),
+		TitleRU:        strings.TrimSpace(ev.Title),
+		TitleOR:        strings.TrimSpace(ev.OriginalTitle),
+		Year:           ev.Year,
+		Duration:       ev.Duration,
+		Release:        ev.DateReleased,
+		AgeRestriction: parseAgeRestriction(ev.ContentRating),
+		Description:    ev.Description,
+		Images:         ev.Image,
+	})
+
+	if len(item.Genres) == 0 {
+		for _, genre := range ev.Genres {
+			item.Genres = append(item.Genres, string(genre))
+		}
+	}
+}
+
+// durationRegexp matches "132 мин." and "2 ч 12 мин."
+var durationRegexp = regexp.MustCompile(`(?:(\d+) ч\.? )?(\d+) мин`)
+
+var kpRegexp = regexp.MustCompile(`kinopoisk.ru/film/(\d+)`)
+
+var isoDurationRegexp = regexp.MustCompile(`^PT(?:(\d+)H)?(?:(\d+)M)?`)
+
+// parseISODuration parses ISO 8601 duration like PT1H58M into minutes
+func parseISODuration(value string) int {
+	match := isoDurationRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return 0
+	}
+
+	hours, _ := strconv.Atoi(match[1])
+	minutes, _ := strconv.Atoi(match[2])
+	return hours*60 + minutes
+}
+
+// applyLDMovie fills empty fields of item from JSON-LD Movie
+func applyLDMovie(item *EventDataItem, m *ldMovie) {
+	if item.TitleRU == "" {
+		item.TitleRU = strings.TrimSpace(m.Name)
+	}
+	if item.TitleOR == "" {
+		item.TitleOR = strings.TrimSpace(m.AlternateName)
+	}
+	if item.Year == 0 && len(m.DateCreated) >= 4 {
+		item.Year, _ = strconv.Atoi(m.DateCreated[:4])
+	}
+	if item.Release.IsZero() && len(m.DatePublished) >= 10 {
+		item.Release, _ = afisha.ParseDate(m.DatePublished[:10])
+	}
+	if item.Duration == 0 {
+		item.Duration = parseISODuration(m.Duration)
+	}
+	if item.AgeRestriction == 0 {
+		item.AgeRestriction = parseAgeRestriction(m.ContentRating)
+	}
+	if len(item.Countries) == 0 {
+		item.Countries = m.CountryOfOrigin
+	}
+
+	if len(item.People) == 0 {
+		roles := []struct {
+			names ldPeople
+			role  string
+		}{
+			{m.Director, RoleDirector},
+			{m.Producer, RoleProducer},
+			{m.MusicBy, RoleComposer},
+			{m.Actor, RoleActor},
+		}
+
+		for _, r := range roles {
+			for _, name := range r.names {
+				item.People = append(item.People, EventPerson{
+					Name: name,
+					Role: r.role,
+				})
+			}
+		}
+	}
+}
+
+// applySelectors fills empty fields of item by scraping page markup
+func applySelectors(item *EventDataItem, doc *goquery.Document, sel EventPageSelectors) {
+	getText := func(s *goquery.Selection, selector string) string {
+		if selector == "" {
+			return ""
+		}
+		return strings.TrimSpace(s.Find(selector).First().Text())
+	}
+
+	if item.AgeRestriction == 0 {
+		item.AgeRestriction = parseAgeRestriction(getText(doc.Selection, sel.AgeRestriction))
+	}
+	if item.KpRating == 0 {
+		kpRate, err := strconv.ParseFloat(getText(doc.Selection, sel.KpRating), 32)
+		if err == nil {
+			item.KpRating = int(kpRate * 100)
+		}
+	}
+	if item.TitleRU == "" {
+		item.TitleRU = getText(doc.Selection, sel.Title)
+	}
+
+	if sel.AttributeRow == "" {
+		return
+	}
+
+	// People are only taken from markup if JSON-LD had none
+	takePeople := len(item.People) == 0
+
+	doc.Find(sel.AttributeRow).Each(func(_ int, s *goquery.Selection) {
+		key := getText(s, sel.AttributeName)
+		value := getText(s, sel.AttributeValue)
+
+		switch key {
+		case "Оригинальное название":
+			if item.TitleOR == "" {
+				item.TitleOR = value
+			}
+		case "Год производства":
+			if item.Year == 0 {
+				item.Year, _ = strconv.Atoi(value)
+			}
+		case "Время":
+			if item.Duration != 0 {
+				break
+			}
+
+			match := durationRegexp.FindStringSubmatch(value)
+			if match == nil {
+				slog.Warn("Failed to parse event page duration", "key", key, "value", value)
+				break
+			}
+
+			hours, _ := strconv.Atoi(match[1])
+			minutes, _ := strconv.Atoi(match[2])
+			item.Duration = hours*60 + minutes
+		case "Страна":
+			if len(item.Countries) == 0 {
+				item.Countries = splitNames(value)
+			}
+		case "Премьера":
+			if !item.Release.IsZero() {
+				break
+			}
+
+			var err error
+			item.Release, err = rudate.ParseDate(value, time.Now())
+			if err != nil {
+				slog.Warn("Failed to parse event page date", "key", key, "value", value, "err", err)
+			}
+
+		case "Режиссёр", "Режиссер":
+			if takePeople {
+				item.People = append(item.People, peopleWithRole(value, RoleDirector)...)
+			}
+		case "Продюсер":
+			if takePeople {
+				item.People = append(item.People, peopleWithRole(value, RoleProducer)...)
+			}
+		case "Композитор":
+			if takePeople {
+				item.People = append(item.People, peopleWithRole(value, RoleComposer)...)
+			}
+		case "В ролях":
+			if takePeople {
+				item.People = append(item.People, peopleWithRole(value, RoleActor)...)
+			}
+
+		default:
+			slog.Debug("Unknown event page category", "key", key)
+		}
+	})
+}
+
+func peopleWithRole(value, role string) []EventPerson {
+	var people []EventPerson
+	for _, name := range splitNames(value) {
+		people = append(people, EventPerson{
+			Name: name,
+			Role: role,
+		})
+	}
+	return people
+}
+
+// parseEventPage extracts event data from afisha event page.
+// JSON-LD is preferred, then state embedded into page script,
+// and CSS selectors are used for fields missing in both.
+// Parse result is recorded to health.
+func parseEventPage(evID string, data []byte, sel EventPageSelectors, health *ParserHealth) (*EventDataItem, error) {
+	var item EventDataItem
+
+	item.EventID = evID
+
+	if match := kpRegexp.FindSubmatch(data); len(match) == 2 {
+		if kpID, err := strconv.Atoi(string(match[1])); err == nil {
+			item.KpID = kpID
+		}
+	}
+
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []string
+	doc.Find(`script[type="application/ld+json"]`).EachWithBreak(func(_ int, s *goquery.Selection) bool {
+		if m := findLDMovie([]byte(s.Text())); m != nil {
+			applyLDMovie(&item, m)
+			sources = append(sources, sourceJSONLD)
+			return false
+		}
+		return true
+	})
+
+	if ev := findStateEvent(doc, evID); ev != nil {
+		applyStateEvent(&item, ev)
+		sources = append(sources, sourceInitialState)
+	}
+
+	applySelectors(&item, doc, sel)
+
+	health.Record(missingFields(&item), sources)
+
+	return &item, nil
+}
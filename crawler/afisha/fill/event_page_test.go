@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stek29/kr/crawler/afisha"
+)
+
+// parseTestPage parses synthetic page from testdata/pages
+func parseTestPage(t *testing.T, name string, sel EventPageSelectors) *EventDataItem {
+	return parseTestPageHealth(t, name, sel, &ParserHealth{})
+}
+
+func parseTestPageHealth(t *testing.T, name string, sel EventPageSelectors, health *ParserHealth) *EventDataItem {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pages", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := parseEventPage("5c6f0e9a1e2fdb0d1f3c2b01", data, sel, health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestParseEventPageJSONLD(t *testing.T) {
+	item := parseTestPage(t, "event_jsonld.html", DefaultEventPageSelectors)
+
+	want := &EventDataItem{
+		EventID:        "5c6f0e9a1e2fdb0d1f3c2b01",
+		KpID:           1008445,
+		TitleRU:        "Аладдин",
+		TitleOR:        "Aladdin",
+		Year:           2019,
+		Duration:       128,
+		Release:        afisha.MakeDate(2019, 5, 23),
+		AgeRestriction: 6,
+		KpRating:       730,
+		Countries:      []string{"США"},
+		People: []EventPerson{
+			{"Гай Ричи", RoleDirector},
+			{"Дэн Лин", RoleProducer},
+			{"Джонатан Айрич", RoleProducer},
+			{"Алан Менкен", RoleComposer},
+			{"Мена Массуд", RoleActor},
+			{"Наоми Скотт", RoleActor},
+			{"Уилл Смит", RoleActor},
+		},
+	}
+
+	if !reflect.DeepEqual(item, want) {
+		t.Errorf("Unexpected item:\n got %+v\nwant %+v", item, want)
+	}
+}
+
+func TestParseEventPageMarkup(t *testing.T) {
+	item := parseTestPage(t, "event_markup.html", DefaultEventPageSelectors)
+
+	want := &EventDataItem{
+		EventID:        "5c6f0e9a1e2fdb0d1f3c2b01",
+		KpID:           840817,
+		TitleRU:        "Годзилла 2: Король монстров",
+		TitleOR:        "Godzilla: King of the Monsters",
+		Year:           2019,
+		Duration:       132,
+		Release:        afisha.MakeDate(2019, 5, 30),
+		AgeRestriction: 12,
+		KpRating:       640,
+		Countries:      []string{"США", "Япония"},
+		People: []EventPerson{
+			{"Майкл Догерти", RoleDirector},
+			{"Кайл Чандлер", RoleActor},
+			{"Вера Фармига", RoleActor},
+			{"Милли Бобби Браун", RoleActor},
+		},
+	}
+
+	if !reflect.DeepEqual(item, want) {
+		t.Errorf("Unexpected item:\n got %+v\nwant %+v", item, want)
+	}
+}
+
+func TestParseEventPageSelectors(t *testing.T) {
+	sel := DefaultEventPageSelectors
+	sel.Title = "h1"
+	sel.AttributeRow = ""
+
+	item := parseTestPage(t, "event_markup.html", sel)
+	if item.TitleRU != "Годзилла 2: Король монстров" {
+		t.Errorf("Custom title selector wasn't used: %q", item.TitleRU)
+	}
+	if item.Year != 0 {
+		t.Errorf("Attributes shouldn't be parsed without row selector")
+	}
+
+	missing := missingFields(item)
+	if !reflect.DeepEqual(missing, []string{fieldTitleOR, fieldYear, fieldDuration, fieldRelease, fieldCountries, fieldPeople}) {
+		t.Errorf("Unexpected missing fields: %v", missing)
+	}
+}
+
+func TestParseEventPageInitialState(t *testing.T) {
+	var health ParserHealth
+	item := parseTestPageHealth(t, "event_state.html", DefaultEventPageSelectors, &health)
+
+	want := &EventDataItem{
+		EventID:        "5c6f0e9a1e2fdb0d1f3c2b01",
+		KpID:           1043758,
+		TitleRU:        "Рокетмен",
+		TitleOR:        "Rocketman",
+		Year:           2019,
+		Duration:       121,
+		Release:        afisha.MakeDate(2019, 6, 6),
+		AgeRestriction: 18,
+		KpRating:       75,
+		Description:    "Музыкальная биография Элтона Джона",
+		Genres:         []string{"биография", "мюзикл"},
+		Countries:      []string{"Великобритания", "США"},
+		People: []EventPerson{
+			{"Декстер Флетчер", RoleDirector},
+			{"Тэрон Эджертон", RoleActor},
+		},
+	}
+
+	if !reflect.DeepEqual(item, want) {
+		t.Errorf("Unexpected item:\n got %+v\nwant %+v", item, want)
+	}
+
+	if health.pages != 1 || health.sources[sourceInitialState] != 1 || health.sources[sourceJSONLD] != 0 {
+		t.Errorf("Unexpected parser health: %+v", health.sources)
+	}
+	if !reflect.DeepEqual(health.failed, map[string]int{}) {
+		t.Errorf("Unexpected failed fields: %v", health.failed)
+	}
+}
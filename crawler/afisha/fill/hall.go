@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/stek29/kr/crawler/afisha/logging"
+)
+
+type HallLoader struct {
+	Loader
+}
+
+func NewHallLoader(db *sql.DB) *HallLoader {
+	return &HallLoader{
+		Loader: *NewLoader(db, LoaderConfig{
+			Table:     "halls",
+			FieldName: "hall_key",
+			FieldID:   "hall_id",
+		}),
+	}
+}
+
+// HallKey is unique hall key -- cinema id and normalized hall name
+func HallKey(cinemaID int, name string) string {
+	return fmt.Sprintf("%d:%s", cinemaID, normalizeName(name))
+}
+
+type HallDataItem struct {
+	CinemaID int
+	Name     string
+}
+
+type HallData []HallDataItem
+
+func (HallData) Fields() []string {
+	return []string{"cinema_id", "name", "hall_key"}
+}
+
+func (HallData) InsertFormat() (string, int) {
+	return "$%d, $%d, $%d", 3
+}
+
+func (d HallData) Names() []string {
+	res := make([]string, len(d))
+	for i := range d {
+		res[i] = HallKey(d[i].CinemaID, d[i].Name)
+	}
+	return res
+}
+
+func (d HallData) Values(filter map[string]struct{}) []interface{} {
+	var res []interface{}
+
+	for _, item := range d {
+		key := HallKey(item.CinemaID, item.Name)
+		if _, ok := filter[key]; !ok {
+			continue
+		}
+
+		var idata [3]interface{}
+
+		idata[0] = item.CinemaID
+		idata[1] = item.Name
+		idata[2] = key
+
+		res = append(res, idata[:]...)
+	}
+
+	return res
+}
+
+// loadHalls sets HallID of sessions, creating missing halls
+func loadHalls(sessions []Session) error {
+	var halls HallData
+	seen := map[string]struct{}{}
+
+	for _, sess := range sessions {
+		if sess.Hall == "" {
+			continue
+		}
+
+		key := HallKey(sess.CinemaID, sess.Hall)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		halls = append(halls, HallDataItem{
+			CinemaID: sess.CinemaID,
+			Name:     sess.Hall,
+		})
+	}
+
+	hallMap := map[string]int{}
+
+	const chunkSize = 100
+	slog.Info("Saving halls", "count", len(halls), "chunk", chunkSize)
+	for i := 0; i < len(halls); i += chunkSize {
+		end := i + chunkSize
+
+		if end > len(halls) {
+			end = len(halls)
+		}
+
+		chunk, err := hallLoader.GetIDsCreating(halls[i:end])
+		if err != nil {
+			return err
+		}
+
+		for key, id := range chunk {
+			hallMap[key] = id
+		}
+	}
+
+	for i := range sessions {
+		if sessions[i].Hall == "" {
+			continue
+		}
+
+		var ok bool
+		sessions[i].HallID, ok = hallMap[HallKey(sessions[i].CinemaID, sessions[i].Hall)]
+		if !ok {
+			logging.Fatal("Unexpected hallMap cache miss", "cinema", sessions[i].CinemaID, "hall", sessions[i].Hall)
+		}
+	}
+
+	return nil
+}
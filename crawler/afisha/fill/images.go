@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxImageSize limits downloaded image size
+const maxImageSize = 20 << 20
+
+// imageExt guesses image file extension by content type or url
+func imageExt(contentType, imageURL string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case "image/jpeg":
+			return ".jpg"
+		case "image/png":
+			return ".png"
+		case "image/webp":
+			return ".webp"
+		case "image/gif":
+			return ".gif"
+		}
+	}
+
+	return strings.ToLower(path.Ext(imageURL))
+}
+
+// downloadImage saves image into dir with name based on content hash.
+// Existing file with same content is reused.
+func downloadImage(dir, imageURL string) (fileName, hash string, err error) {
+	// afisha often uses protocol relative URLs
+	if strings.HasPrefix(imageURL, "//") {
+		imageURL = "https:" + imageURL
+	}
+
+	resp, err := imageClient.Get(imageURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", "", errors.Errorf("Status code is %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return "", "", err
+	}
+	if len(data) > maxImageSize {
+		return "", "", errors.New("Image is too large")
+	}
+
+	sum := sha256.Sum256(data)
+	hash = hex.EncodeToString(sum[:])
+	fileName = hash + imageExt(resp.Header.Get("Content-Type"), imageURL)
+	fullPath := filepath.Join(dir, fileName)
+
+	if _, err := os.Stat(fullPath); err == nil {
+		return fileName, hash, nil
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", err
+	}
+
+	return fileName, hash, os.Rename(tmp.Name(), fullPath)
+}
+
+// downloadImages caches movie images which weren't downloaded yet into dir
+func downloadImages(db *sql.DB, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Failed to prepare image dir")
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT url FROM movie_images WHERE local_path IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	var urls []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		urls = append(urls, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	slog.Info("Downloading images", "count", len(urls))
+
+	for i, u := range urls {
+		fileName, hash, err := downloadImage(dir, u)
+		if err != nil {
+			slog.Warn("Failed to download image, skipping", "index", i+1, "total", len(urls), "url", u, "err", err)
+			continue
+		}
+
+		_, err = db.Exec(`UPDATE movie_images SET local_path = $1, sha256 = $2 WHERE url = $3`, fileName, hash, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"strconv"
 	"strings"
 	"sync"
+
+	"github.com/stek29/kr/crawler/afisha/metrics"
 )
 
 var ErrNotFound = sql.ErrNoRows
@@ -15,6 +18,7 @@ type Loader struct {
 	mu    sync.RWMutex
 	db    *sql.DB
 	cfg   LoaderConfig
+	log   *slog.Logger
 }
 
 type LoaderConfig struct {
@@ -28,6 +32,7 @@ func NewLoader(db *sql.DB, config LoaderConfig) *Loader {
 		cache: make(map[string]int),
 		db:    db,
 		cfg:   config,
+		log:   slog.Default().With("table", config.Table),
 	}
 }
 
@@ -74,6 +79,10 @@ func (l *Loader) GetIDs(names []string) (map[string]int, error) {
 	}
 	l.mu.RUnlock()
 
+	l.log.Debug("Looking up IDs", "names", len(unames), "cached", len(results))
+	metrics.CacheLookups.WithLabelValues(l.cfg.Table, "hit").Add(float64(len(results)))
+	metrics.CacheLookups.WithLabelValues(l.cfg.Table, "miss").Add(float64(len(missNames)))
+
 	if len(missNames) == 0 {
 		return results, nil
 	}
@@ -168,6 +177,9 @@ func (l *Loader) InsertData(data LoadableData, names map[string]struct{}) (map[s
 		l.cache[name] = id
 	}
 
+	l.log.Debug("Inserted rows", "count", len(results))
+	metrics.RowsInserted.WithLabelValues(l.cfg.Table).Add(float64(len(results)))
+
 	return results, nil
 }
 
@@ -200,3 +212,30 @@ func (l *Loader) GetIDsCreating(data LoadableData) (map[string]int, error) {
 
 	return result, nil
 }
+
+// NameData is LoadableData for tables where name is the only field
+type NameData []string
+
+func (NameData) Fields() []string {
+	return []string{"name"}
+}
+
+func (NameData) InsertFormat() (string, int) {
+	return "$%d", 1
+}
+
+func (d NameData) Names() []string {
+	return d
+}
+
+func (d NameData) Values(filter map[string]struct{}) []interface{} {
+	var res []interface{}
+
+	for _, name := range d {
+		if _, ok := filter[name]; ok {
+			res = append(res, name)
+		}
+	}
+
+	return res
+}
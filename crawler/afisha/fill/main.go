@@ -3,14 +3,23 @@ package main
 import (
 	"database/sql"
 	"flag"
-	"log"
-	"strings"
+	"log/slog"
+	"net/http"
+	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/changelog"
+	"github.com/stek29/kr/crawler/afisha/config"
+	"github.com/stek29/kr/crawler/afisha/logging"
+	"github.com/stek29/kr/crawler/afisha/metrics"
+	"github.com/stek29/kr/crawler/afisha/util"
 )
 
 var (
 	outDir string
+	// backfillEvents enables fetching details of incomplete movies which are already saved
+	backfillEvents bool
 )
 
 const (
@@ -24,49 +33,153 @@ var (
 	tzLoader    *TZLoader
 	placeLoader *PlaceLoader
 	eventLoader *EventLoader
+	hallLoader  *HallLoader
+	metroLoader *MetroLoader
+	chainLoader *ChainLoader
+
+	personLoader  *PersonLoader
+	countryLoader *CountryLoader
+	genreLoader   *GenreLoader
+)
+
+var chainOverrides ChainOverrides
+
+// requestTimeout limits every request of fill, so one stalled server doesn't hang it
+const requestTimeout = time.Minute
+
+var (
+	// afishaClient fetches event details and pages
+	afishaClient = &http.Client{Timeout: requestTimeout}
+	// imageClient downloads images, it's rate limited separately since images are served by CDN
+	imageClient = &http.Client{Timeout: requestTimeout}
 )
 
 func main() {
 	var connStr string
 
+	configFile := config.RegisterFlags(flag.CommandLine)
 	flag.StringVar(&outDir, "out", "", "Crawl result output dir")
+	storageBackend := config.RegisterStorageFlags(flag.CommandLine)
+	flag.StringVar(&afisha.BaseURL, "afisha-url", afisha.BaseURL, "Yandex.Afisha base URL")
 	flag.StringVar(&connStr, "conn", "", "Postgres connection specifier")
+	changesOnly := flag.Bool("changes-only", false, "Only fill places and sessions changed since they were last filled according to crawl change log")
+	doFillCities := flag.Bool("fill-cities", false, "Fill and update cities")
 	doFillPlaces := flag.Bool("fill-places", false, "Fill places")
-	doFillSessions := flag.String("fill-sessions", "", "Fill sessions for dates (comma separated)")
+	chainOverridesFile := flag.String("chain-overrides", "", "Cinema chain detection overrides in JSON")
+	eventSelectorsFile := flag.String("event-selectors", "", "CSS selectors for event page scraping in JSON, overriding defaults")
+	doFillSessions := flag.String("fill-sessions", "", "Fill sessions for dates (comma separated, ranges like 2019-06-01..2019-06-07 or today+7)")
+	flag.BoolVar(&backfillEvents, "backfill-events", false, "Fetch and save people, countries, genres, images, description, age restriction and duration of already saved movies missing them")
+	doMergeMovies := flag.Bool("merge-movies", false, "Merge duplicate movies of different events")
+	mergeReportFile := flag.String("merge-report", "", "Save ambiguous duplicate movies in JSON")
+	downloadImagesDir := flag.String("download-images", "", "Download movie images to dir")
+
+	rateLimit := flag.Float64("rate-limit", 0, "Max Afisha requests per second, same limit applies to image downloads, 0 means no limit")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at address, like :9100")
 
+	var logOpts logging.Options
+	logOpts.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := config.Setup(flag.CommandLine, *configFile); err != nil {
+		logging.Fatal("Invalid config", "err", err)
+	}
+
+	if _, err := logOpts.Setup(); err != nil {
+		logging.Fatal("Invalid logging flags", "err", err)
+	}
+
+	// Rate limiter waits outside of metrics, so waits aren't measured as request latency
+	afishaClient.Transport = afisha.RateLimited(metrics.Transport(http.DefaultTransport), *rateLimit)
+	imageClient.Transport = afisha.RateLimited(http.DefaultTransport, *rateLimit)
+	if *metricsAddr != "" {
+		metrics.Serve(*metricsAddr)
+	}
+
 	if outDir == "" {
-		log.Fatal("out is required")
+		logging.Fatal("out is required")
 	}
+	slog.Debug("Reading crawl results", "dir", outDir, "storage", *storageBackend)
 
 	if connStr == "" {
-		log.Fatal("conn is required")
+		logging.Fatal("conn is required")
+	}
+
+	if *changesOnly {
+		var err error
+		changes, err = changelog.Load(outDir)
+		if err != nil {
+			logging.Fatal("Failed to load change log", "err", err)
+		}
+		slog.Info("Loaded change log", "time", changes.Time, "units", len(changes.Units), "changes", len(changes.Changes))
+	}
+
+	if *chainOverridesFile != "" {
+		if err := util.UnmarshalFromFile(*chainOverridesFile, &chainOverrides); err != nil {
+			logging.Fatal("Failed to load chain overrides", "file", *chainOverridesFile, "err", err)
+		}
+	}
+
+	if *eventSelectorsFile != "" {
+		if err := util.UnmarshalFromFile(*eventSelectorsFile, &eventPageSelectors); err != nil {
+			logging.Fatal("Failed to load event selectors", "file", *eventSelectorsFile, "err", err)
+		}
 	}
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
-		log.Fatal("Failed to Open database", err)
+		logging.Fatal("Failed to open database", "err", err)
 	}
 
 	cityLoader = NewCityLoader(db)
 	tzLoader = NewTZLoader(db)
 	placeLoader = NewPlaceLoader(db)
 	eventLoader = NewEventLoader(db)
+	hallLoader = NewHallLoader(db)
+	metroLoader = NewMetroLoader(db)
+	chainLoader = NewChainLoader(db)
+	personLoader = NewPersonLoader(db)
+	countryLoader = NewCountryLoader(db)
+	genreLoader = NewGenreLoader(db)
+
+	if *doFillCities {
+		if err := fillCities(db); err != nil {
+			logging.Fatal("fillCities failed", "err", err)
+		}
+	}
 
 	if *doFillPlaces {
 		err = fillPlaces(db)
 		if err != nil {
-			log.Fatal("fillPlaces failed:", err)
+			logging.Fatal("fillPlaces failed", "err", err)
 		}
 	}
 
 	if *doFillSessions != "" {
-		dates := strings.Split(*doFillSessions, ",")
+		dates, err := afisha.ParseDates(*doFillSessions, afisha.Today())
+		if err != nil {
+			logging.Fatal("Invalid dates for fill-sessions", "dates", *doFillSessions, "err", err)
+		}
+
 		for _, date := range dates {
 			if err := fillSessions(db, date); err != nil {
-				log.Fatalf("Failed to fill sessions for date: `%v` (%v)", date, err)
+				logging.Fatal("Failed to fill sessions", "date", date, "err", err)
 			}
 		}
 	}
+
+	if *doMergeMovies {
+		if err := mergeMovies(db, *mergeReportFile); err != nil {
+			logging.Fatal("mergeMovies failed", "err", err)
+		}
+	}
+
+	if *downloadImagesDir != "" {
+		if err := downloadImages(db, *downloadImagesDir); err != nil {
+			logging.Fatal("downloadImages failed", "err", err)
+		}
+	}
+
+	if err := acknowledgeChanges(); err != nil {
+		logging.Fatal("Failed to acknowledge filled changes", "err", err)
+	}
 }
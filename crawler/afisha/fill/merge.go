@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha/util"
+)
+
+type movieRow struct {
+	MovieID   int    `json:"movie_id"`
+	EventID   string `json:"ya_event_id,omitempty"`
+	KpID      int    `json:"kp_id,omitempty"`
+	TitleRU   string `json:"title_ru,omitempty"`
+	TitleOR   string `json:"title_or,omitempty"`
+	Year      int    `json:"year,omitempty"`
+	titleNorm string
+}
+
+// AmbiguousMovies are movies with same title which can't be merged automatically
+type AmbiguousMovies struct {
+	Title  string     `json:"title"`
+	Movies []movieRow `json:"movies"`
+}
+
+func loadMovieRows(db *sql.DB) ([]movieRow, error) {
+	rows, err := db.Query(`
+		SELECT movie_id, coalesce(ya_event_id, ''), coalesce(kp_id, 0),
+		       coalesce(title_ru, ''), coalesce(title_or, ''), coalesce(year, 0)
+		FROM movies
+		ORDER BY movie_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movies []movieRow
+	for rows.Next() {
+		var m movieRow
+		if err := rows.Scan(&m.MovieID, &m.EventID, &m.KpID, &m.TitleRU, &m.TitleOR, &m.Year); err != nil {
+			return nil, err
+		}
+		m.titleNorm = normalizeName(m.TitleRU)
+		movies = append(movies, m)
+	}
+
+	return movies, rows.Err()
+}
+
+// movieMergeStatements move everything referencing $2 movie to $1 movie
+var movieMergeStatements = []string{
+	`UPDATE event_aliases SET movie_id = $1 WHERE movie_id = $2`,
+	`UPDATE sessions SET movie_id = $1 WHERE movie_id = $2`,
+	`INSERT INTO user_movie_ratings (movie_id, user_id, rating)
+		SELECT $1, user_id, rating FROM user_movie_ratings WHERE movie_id = $2
+		ON CONFLICT DO NOTHING`,
+	`INSERT INTO user_starred_movies (movie_id, user_id)
+		SELECT $1, user_id FROM user_starred_movies WHERE movie_id = $2
+		ON CONFLICT DO NOTHING`,
+	`INSERT INTO movie_genres (movie_id, genre_id)
+		SELECT $1, genre_id FROM movie_genres WHERE movie_id = $2
+		ON CONFLICT DO NOTHING`,
+	`INSERT INTO movie_people (movie_id, person_id, role, ord)
+		SELECT $1, person_id, role, ord FROM movie_people WHERE movie_id = $2
+		ON CONFLICT DO NOTHING`,
+	`INSERT INTO movie_countries (movie_id, country_code)
+		SELECT $1, country_code FROM movie_countries WHERE movie_id = $2
+		ON CONFLICT DO NOTHING`,
+	`INSERT INTO movie_images (movie_id, kind, url, width, height, local_path, sha256)
+		SELECT $1, kind, url, width, height, local_path, sha256 FROM movie_images WHERE movie_id = $2
+		ON CONFLICT DO NOTHING`,
+	`DELETE FROM movies WHERE movie_id = $2`,
+}
+
+// mergeMovie links event of duplicate movie to canonical one and removes duplicate
+func mergeMovie(db *sql.DB, canonical, dup movieRow) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if dup.EventID != "" {
+		_, err = txn.Exec(`
+			INSERT INTO event_aliases (ya_event_id, movie_id) VALUES ($1, $2)
+			ON CONFLICT (ya_event_id) DO UPDATE SET movie_id = excluded.movie_id`, dup.EventID, canonical.MovieID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range movieMergeStatements {
+		if _, err := txn.Exec(stmt, canonical.MovieID, dup.MovieID); err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// pickCanonical prefers movies with kinopoisk id, then oldest ones
+func pickCanonical(movies []movieRow) (canonical movieRow, dups []movieRow) {
+	sort.Slice(movies, func(i, j int) bool {
+		if (movies[i].KpID != 0) != (movies[j].KpID != 0) {
+			return movies[i].KpID != 0
+		}
+		return movies[i].MovieID < movies[j].MovieID
+	})
+	return movies[0], movies[1:]
+}
+
+// planMovieMerges groups duplicate movies by kinopoisk id and normalized title.
+// Movies with same title but different kinopoisk ids or years are reported as ambiguous.
+func planMovieMerges(movies []movieRow) (merges map[int][]movieRow, canonicals map[int]movieRow, ambiguous []AmbiguousMovies) {
+	merges = map[int][]movieRow{}
+	canonicals = map[int]movieRow{}
+
+	byKp := map[int][]movieRow{}
+	var rest []movieRow
+
+	for _, m := range movies {
+		if m.KpID != 0 {
+			byKp[m.KpID] = append(byKp[m.KpID], m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+
+	for _, group := range byKp {
+		canonical, dups := pickCanonical(group)
+		if len(dups) != 0 {
+			merges[canonical.MovieID] = append(merges[canonical.MovieID], dups...)
+			canonicals[canonical.MovieID] = canonical
+		}
+		rest = append(rest, canonical)
+	}
+
+	byTitle := map[string][]movieRow{}
+	for _, m := range rest {
+		if m.titleNorm == "" {
+			continue
+		}
+		byTitle[m.titleNorm] = append(byTitle[m.titleNorm], m)
+	}
+
+	for _, group := range byTitle {
+		if len(group) < 2 {
+			continue
+		}
+
+		kpIDs := map[int]struct{}{}
+		years := map[int]struct{}{}
+		for _, m := range group {
+			if m.KpID != 0 {
+				kpIDs[m.KpID] = struct{}{}
+			}
+			if m.Year != 0 {
+				years[m.Year] = struct{}{}
+			}
+		}
+
+		if len(kpIDs) > 1 || len(years) > 1 {
+			sort.Slice(group, func(i, j int) bool { return group[i].MovieID < group[j].MovieID })
+			ambiguous = append(ambiguous, AmbiguousMovies{
+				Title:  group[0].TitleRU,
+				Movies: group,
+			})
+			continue
+		}
+
+		canonical, dups := pickCanonical(group)
+		// canonical might have been a duplicate target already
+		merges[canonical.MovieID] = append(merges[canonical.MovieID], dups...)
+		canonicals[canonical.MovieID] = canonical
+
+		for _, dup := range dups {
+			if dupDups, ok := merges[dup.MovieID]; ok {
+				merges[canonical.MovieID] = append(merges[canonical.MovieID], dupDups...)
+				delete(merges, dup.MovieID)
+				delete(canonicals, dup.MovieID)
+			}
+		}
+	}
+
+	sort.Slice(ambiguous, func(i, j int) bool { return ambiguous[i].Title < ambiguous[j].Title })
+
+	return merges, canonicals, ambiguous
+}
+
+// mergeMovies merges duplicate movies created for different afisha events.
+// Ambiguous candidates are logged and saved to reportFile if it's set.
+func mergeMovies(db *sql.DB, reportFile string) error {
+	movies, err := loadMovieRows(db)
+	if err != nil {
+		return errors.Wrap(err, "Failed to load movies")
+	}
+	slog.Info("Loaded movies", "count", len(movies))
+
+	merges, canonicals, ambiguous := planMovieMerges(movies)
+
+	merged := 0
+	for canonicalID, dups := range merges {
+		canonical := canonicals[canonicalID]
+		for _, dup := range dups {
+			slog.Info("Merging movie", "movie", dup.MovieID, "event", dup.EventID, "into_movie", canonical.MovieID, "into_event", canonical.EventID)
+			if err := mergeMovie(db, canonical, dup); err != nil {
+				return errors.Wrapf(err, "Failed to merge movie %d into %d", dup.MovieID, canonical.MovieID)
+			}
+			merged++
+		}
+	}
+	slog.Info("Merged duplicate movies", "count", merged)
+
+	for _, amb := range ambiguous {
+		ids := make([]int, len(amb.Movies))
+		for i, m := range amb.Movies {
+			ids[i] = m.MovieID
+		}
+		slog.Warn("Ambiguous duplicate movies, review manually", "title", amb.Title, "movies", ids)
+	}
+
+	if reportFile != "" {
+		if err := util.MarshalIntoFile(reportFile, ambiguous); err != nil {
+			return errors.Wrap(err, "Failed to save merge report")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testMovie(id, kpID int, title string, year int) movieRow {
+	return movieRow{MovieID: id, KpID: kpID, TitleRU: title, Year: year, titleNorm: normalizeName(title)}
+}
+
+// movieIDs maps canonical movie ids to sorted ids of its duplicates
+func movieIDs(merges map[int][]movieRow) map[int][]int {
+	result := map[int][]int{}
+	for id, dups := range merges {
+		for _, dup := range dups {
+			result[id] = append(result[id], dup.MovieID)
+		}
+		sort.Ints(result[id])
+	}
+	return result
+}
+
+func TestPlanMovieMerges(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		movies    []movieRow
+		merges    map[int][]int
+		ambiguous [][]int
+	}{
+		{
+			name: "same kp_id",
+			movies: []movieRow{
+				testMovie(1, 1008445, "Аладдин", 2019),
+				testMovie(2, 1008445, "Аладдин (2019)", 0),
+			},
+			merges: map[int][]int{1: {2}},
+		},
+		{
+			name: "same title without kp_id",
+			movies: []movieRow{
+				testMovie(1, 0, "Аладдин", 2019),
+				testMovie(2, 1008445, "АЛАДДИН", 2019),
+				testMovie(3, 0, "Аладдин", 0),
+			},
+			// Movie with kp_id is preferred over older one
+			merges: map[int][]int{2: {1, 3}},
+		},
+		{
+			name: "same kp_id and title",
+			movies: []movieRow{
+				testMovie(1, 1008445, "Аладдин", 2019),
+				testMovie(2, 0, "Аладдин", 2019),
+				testMovie(3, 1008445, "Aladdin", 2019),
+			},
+			merges: map[int][]int{1: {2, 3}},
+		},
+		{
+			name: "different kp_id",
+			movies: []movieRow{
+				testMovie(1, 409424, "Дюна", 0),
+				testMovie(2, 1238, "Дюна", 0),
+				testMovie(3, 0, "Дюна", 0),
+			},
+			merges:    map[int][]int{},
+			ambiguous: [][]int{{1, 2, 3}},
+		},
+		{
+			name: "different year",
+			movies: []movieRow{
+				testMovie(1, 0, "Дюна", 2021),
+				testMovie(2, 0, "Дюна", 1984),
+				testMovie(3, 0, "Аладдин", 2019),
+				testMovie(4, 0, "Аладдин", 2019),
+			},
+			merges:    map[int][]int{3: {4}},
+			ambiguous: [][]int{{1, 2}},
+		},
+		{
+			name: "unknown title",
+			movies: []movieRow{
+				testMovie(1, 0, "", 2019),
+				testMovie(2, 0, "", 2019),
+			},
+			merges: map[int][]int{},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			merges, canonicals, ambiguous := planMovieMerges(c.movies)
+
+			if got := movieIDs(merges); !reflect.DeepEqual(got, c.merges) {
+				t.Errorf("Merges are %v, want %v", got, c.merges)
+			}
+			for id := range merges {
+				if canonicals[id].MovieID != id {
+					t.Errorf("Canonical movie %d is %+v", id, canonicals[id])
+				}
+			}
+
+			var gotAmbiguous [][]int
+			for _, a := range ambiguous {
+				var ids []int
+				for _, m := range a.Movies {
+					ids = append(ids, m.MovieID)
+				}
+				gotAmbiguous = append(gotAmbiguous, ids)
+			}
+			if !reflect.DeepEqual(gotAmbiguous, c.ambiguous) {
+				t.Errorf("Ambiguous movies are %v, want %v", gotAmbiguous, c.ambiguous)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/lib/pq"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/logging"
+)
+
+type MetroLoader struct {
+	Loader
+}
+
+func NewMetroLoader(db *sql.DB) *MetroLoader {
+	return &MetroLoader{
+		Loader: *NewLoader(db, LoaderConfig{
+			Table:     "metro_stations",
+			FieldName: "station_key",
+			FieldID:   "station_id",
+		}),
+	}
+}
+
+// MetroKey is unique metro station key -- city id and normalized station name
+func MetroKey(cityID int, name string) string {
+	return fmt.Sprintf("%d:%s", cityID, normalizeName(name))
+}
+
+type MetroDataItem struct {
+	CityID int
+	Name   string
+	Colors []string
+}
+
+type MetroData []MetroDataItem
+
+func (MetroData) Fields() []string {
+	return []string{"city_id", "name", "colors", "station_key"}
+}
+
+func (MetroData) InsertFormat() (string, int) {
+	return "$%d, $%d, $%d, $%d", 4
+}
+
+func (d MetroData) Names() []string {
+	res := make([]string, len(d))
+	for i := range d {
+		res[i] = MetroKey(d[i].CityID, d[i].Name)
+	}
+	return res
+}
+
+func (d MetroData) Values(filter map[string]struct{}) []interface{} {
+	var res []interface{}
+
+	for _, item := range d {
+		key := MetroKey(item.CityID, item.Name)
+		if _, ok := filter[key]; !ok {
+			continue
+		}
+
+		var idata [4]interface{}
+
+		idata[0] = item.CityID
+		idata[1] = item.Name
+		idata[2] = pq.Array(item.Colors)
+		idata[3] = key
+
+		res = append(res, idata[:]...)
+	}
+
+	return res
+}
+
+// fillPlaceRelations saves metro stations and links of places.
+// placeIDs maps place ya_id to cinema_id, cityIDs maps city ya_name to city_id
+func fillPlaceRelations(db *sql.DB, places []afisha.Place, placeIDs, cityIDs map[string]int) error {
+	var stations MetroData
+	seen := map[string]struct{}{}
+
+	for _, pl := range places {
+		cityID := cityIDs[pl.City.ID]
+
+		for _, metro := range pl.Metro {
+			key := MetroKey(cityID, metro.Name)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			stations = append(stations, MetroDataItem{
+				CityID: cityID,
+				Name:   metro.Name,
+				Colors: metro.Colors,
+			})
+		}
+	}
+
+	stationIDs := map[string]int{}
+
+	const chunkSize = 100
+	slog.Info("Saving metro stations", "count", len(stations), "chunk", chunkSize)
+	for i := 0; i < len(stations); i += chunkSize {
+		end := i + chunkSize
+
+		if end > len(stations) {
+			end = len(stations)
+		}
+
+		chunk, err := metroLoader.GetIDsCreating(stations[i:end])
+		if err != nil {
+			return err
+		}
+
+		for key, id := range chunk {
+			stationIDs[key] = id
+		}
+	}
+
+	var metroRows, linkRows [][]interface{}
+
+	for _, pl := range places {
+		placeID, ok := placeIDs[pl.ID]
+		if !ok {
+			logging.Fatal("Unexpected placeIDs cache miss", "place", pl.ID)
+		}
+		cityID := cityIDs[pl.City.ID]
+
+		for _, metro := range pl.Metro {
+			stationID, ok := stationIDs[MetroKey(cityID, metro.Name)]
+			if !ok {
+				logging.Fatal("Unexpected stationIDs cache miss", "station", metro.Name, "city", pl.City.ID)
+			}
+			metroRows = append(metroRows, []interface{}{placeID, stationID})
+		}
+
+		for _, link := range pl.Links {
+			linkRows = append(linkRows, []interface{}{placeID, link})
+		}
+	}
+
+	slog.Info("Saving cinema metro stations", "count", len(metroRows))
+	if err := InsertRelations(db, "cinema_metro", []string{"cinema_id", "station_id"}, metroRows); err != nil {
+		return err
+	}
+
+	slog.Info("Saving cinema links", "count", len(linkRows))
+	if err := InsertRelations(db, "cinema_links", []string{"cinema_id", "url"}, linkRows); err != nil {
+		return err
+	}
+
+	return nil
+}
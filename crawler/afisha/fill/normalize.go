@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalizeName makes name suitable for fuzzy equality checks:
+// lowercases it, replaces ё with е, drops punctuation and collapses spaces
+func normalizeName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.Replace(name, "ё", "е", -1)
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, name)
+
+	return strings.Join(strings.Fields(name), " ")
+}
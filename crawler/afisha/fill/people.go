@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"strings"
+
+	"github.com/stek29/kr/crawler/afisha/logging"
+)
+
+// Roles of people in movie_people
+const (
+	RoleDirector = "director"
+	RoleProducer = "producer"
+	RoleComposer = "composer"
+	RoleActor    = "actor"
+)
+
+// EventPerson is person taking part in event with specific role
+type EventPerson struct {
+	Name string
+	Role string
+}
+
+type PersonLoader struct {
+	Loader
+}
+
+func NewPersonLoader(db *sql.DB) *PersonLoader {
+	return &PersonLoader{
+		Loader: *NewLoader(db, LoaderConfig{
+			Table:     "people",
+			FieldName: "name",
+			FieldID:   "person_id",
+		}),
+	}
+}
+
+// splitNames splits comma separated list of names, like "Джош Кули, Том Хэнкс и др."
+func splitNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		name = strings.TrimSpace(strings.TrimSuffix(name, "и др."))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CountryLoader resolves country names in russian or english to country codes
+type CountryLoader struct {
+	db    *sql.DB
+	codes map[string]string
+}
+
+// countryAliases are names used by afisha which differ from ones in countries table
+var countryAliases = map[string]string{
+	"южная корея":    "KR",
+	"корея южная":    "KR",
+	"северная корея": "KP",
+	"тайвань":        "TW",
+	"македония":      "MK",
+	"молдова":        "MD",
+	"англия":         "GB",
+}
+
+func NewCountryLoader(db *sql.DB) *CountryLoader {
+	return &CountryLoader{
+		db: db,
+	}
+}
+
+func (l *CountryLoader) load() error {
+	rows, err := l.db.Query(`SELECT country_code, name_ru, name_en FROM countries`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	codes := map[string]string{}
+	for name, code := range countryAliases {
+		codes[name] = code
+	}
+
+	for rows.Next() {
+		var code, nameRU, nameEN string
+		if err := rows.Scan(&code, &nameRU, &nameEN); err != nil {
+			return err
+		}
+		codes[normalizeName(nameRU)] = code
+		codes[normalizeName(nameEN)] = code
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	l.codes = codes
+	return nil
+}
+
+// GetCodes resolves country names to codes, unknown countries are logged and skipped
+func (l *CountryLoader) GetCodes(names []string) ([]string, error) {
+	if l.codes == nil {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	var codes []string
+	for _, name := range names {
+		code, ok := l.codes[normalizeName(name)]
+		if !ok {
+			slog.Warn("Unknown country", "country", name)
+			continue
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+type GenreLoader struct {
+	Loader
+}
+
+func NewGenreLoader(db *sql.DB) *GenreLoader {
+	return &GenreLoader{
+		Loader: *NewLoader(db, LoaderConfig{
+			Table:     "genres",
+			FieldName: "name_ru",
+			FieldID:   "genre_id",
+		}),
+	}
+}
+
+// GenreData is NameData for genres, which are named in russian
+type GenreData struct {
+	NameData
+}
+
+func (GenreData) Fields() []string {
+	return []string{"name_ru"}
+}
+
+// fillEventRelations saves people, countries, genres and images of created events.
+// movieIDs maps event id to movie id.
+func fillEventRelations(db *sql.DB, events EventData, movieIDs map[string]int) error {
+	var people NameData
+	seen := map[string]struct{}{}
+
+	for _, ev := range events {
+		for _, p := range ev.People {
+			if _, ok := seen[p.Name]; !ok {
+				seen[p.Name] = struct{}{}
+				people = append(people, p.Name)
+			}
+		}
+	}
+
+	personIDs := map[string]int{}
+
+	const chunkSize = 500
+	slog.Info("Saving people", "count", len(people), "chunk", chunkSize)
+	for i := 0; i < len(people); i += chunkSize {
+		end := i + chunkSize
+
+		if end > len(people) {
+			end = len(people)
+		}
+
+		chunk, err := personLoader.GetIDsCreating(people[i:end])
+		if err != nil {
+			return err
+		}
+
+		for name, id := range chunk {
+			personIDs[name] = id
+		}
+	}
+
+	var genres GenreData
+	seen = map[string]struct{}{}
+	for _, ev := range events {
+		for _, genre := range ev.Genres {
+			if _, ok := seen[genre]; !ok {
+				seen[genre] = struct{}{}
+				genres.NameData = append(genres.NameData, genre)
+			}
+		}
+	}
+
+	slog.Info("Saving genres", "count", len(genres.NameData))
+	genreIDs, err := genreLoader.GetIDsCreating(genres)
+	if err != nil {
+		return err
+	}
+
+	var peopleRows, countryRows, genreRows, imageRows [][]interface{}
+
+	for _, ev := range events {
+		movieID, ok := movieIDs[ev.EventID]
+		if !ok {
+			logging.Fatal("Unexpected movieIDs cache miss", "event", ev.EventID)
+		}
+
+		// ord is position of person in credits for the role
+		ords := map[string]int{}
+		for _, p := range ev.People {
+			personID, ok := personIDs[p.Name]
+			if !ok {
+				logging.Fatal("Unexpected personIDs cache miss", "person", p.Name)
+			}
+			peopleRows = append(peopleRows, []interface{}{movieID, personID, p.Role, ords[p.Role]})
+			ords[p.Role]++
+		}
+
+		for _, code := range ev.CountryCodes {
+			countryRows = append(countryRows, []interface{}{movieID, code})
+		}
+
+		for _, genre := range ev.Genres {
+			genreID, ok := genreIDs[genre]
+			if !ok {
+				logging.Fatal("Unexpected genreIDs cache miss", "genre", genre)
+			}
+			genreRows = append(genreRows, []interface{}{movieID, genreID})
+		}
+
+		for kind, img := range ev.Images {
+			var width, height interface{}
+			if img.Width != 0 {
+				width = img.Width
+			}
+			if img.Height != 0 {
+				height = img.Height
+			}
+			imageRows = append(imageRows, []interface{}{movieID, kind, img.URL, width, height})
+		}
+	}
+
+	slog.Info("Saving movie people", "count", len(peopleRows))
+	if err := InsertRelations(db, "movie_people", []string{"movie_id", "person_id", "role", "ord"}, peopleRows); err != nil {
+		return err
+	}
+
+	slog.Info("Saving movie countries", "count", len(countryRows))
+	if err := InsertRelations(db, "movie_countries", []string{"movie_id", "country_code"}, countryRows); err != nil {
+		return err
+	}
+
+	slog.Info("Saving movie genres", "count", len(genreRows))
+	if err := InsertRelations(db, "movie_genres", []string{"movie_id", "genre_id"}, genreRows); err != nil {
+		return err
+	}
+
+	slog.Info("Saving movie images", "count", len(imageRows))
+	return InsertRelations(db, "movie_images", []string{"movie_id", "kind", "url", "width", "height"}, imageRows)
+}
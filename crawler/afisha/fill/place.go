@@ -2,12 +2,15 @@ package main
 
 import (
 	"database/sql"
-	"log"
+	"log/slog"
 	"path"
 	"path/filepath"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/metrics"
 	"github.com/stek29/kr/crawler/afisha/util"
 )
 
@@ -29,19 +32,22 @@ type PlaceDataItem struct {
 	CityID  int
 	Name    string
 	Address string
-	Lat     float32
-	Long    float32
-	YaID    string
+	// Location is stored only if Coordinates are valid
+	Coordinates afisha.Coordinates
+	YaID        string
+
+	LogoColor afisha.Color
+	BGColor   afisha.Color
 }
 
 type PlaceData []PlaceDataItem
 
 func (PlaceData) Fields() []string {
-	return []string{"name", "address", "loc", "city_id", "ya_id"}
+	return []string{"name", "address", "loc", "city_id", "ya_id", "logo_color", "bg_color"}
 }
 
 func (PlaceData) InsertFormat() (string, int) {
-	return "$%d, $%d, point($%d, $%d), $%d, $%d", 6
+	return "$%d, $%d, point($%d, $%d), $%d, $%d, $%d, $%d", 8
 }
 
 func (d PlaceData) Names() []string {
@@ -60,14 +66,23 @@ func (d PlaceData) Values(filter map[string]struct{}) []interface{} {
 			continue
 		}
 
-		var idata [6]interface{}
+		var idata [8]interface{}
 
 		idata[0] = item.Name
 		idata[1] = item.Address
-		idata[2] = item.Lat
-		idata[3] = item.Long
+		// point is (x, y), that is (longitude, latitude)
+		if item.Coordinates.Valid() {
+			idata[2] = item.Coordinates.Longitude
+			idata[3] = item.Coordinates.Latitude
+		}
 		idata[4] = item.CityID
 		idata[5] = item.YaID
+		if !item.LogoColor.IsZero() {
+			idata[6] = item.LogoColor.String()
+		}
+		if !item.BGColor.IsZero() {
+			idata[7] = item.BGColor.String()
+		}
 
 		res = append(res, idata[:]...)
 	}
@@ -75,86 +90,138 @@ func (d PlaceData) Values(filter map[string]struct{}) []interface{} {
 	return res
 }
 
+// placeColorsImportTable is a temporary table colors are copied into
+// before updating existing cinemas
+const placeColorsImportTable = "cinema_colors_import"
+
+// updatePlaceColors updates branding colors of cinemas already in database,
+// since GetIDsCreating only sets them for new ones.
+// Colors missing in crawl don't overwrite known ones.
+func updatePlaceColors(db *sql.DB, places PlaceData) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`CREATE TEMP TABLE ` + placeColorsImportTable + ` (
+		ya_id      char(24),
+		logo_color char(7),
+		bg_color   char(7)
+	) ON COMMIT DROP`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create import table")
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn(placeColorsImportTable, "ya_id", "logo_color", "bg_color"))
+	if err != nil {
+		return err
+	}
+
+	copyStart := time.Now()
+	copied := 0
+	for _, item := range places {
+		if item.LogoColor.IsZero() && item.BGColor.IsZero() {
+			continue
+		}
+
+		var logoColor, bgColor interface{}
+		if !item.LogoColor.IsZero() {
+			logoColor = item.LogoColor.String()
+		}
+		if !item.BGColor.IsZero() {
+			bgColor = item.BGColor.String()
+		}
+
+		if _, err := stmt.Exec(item.YaID, logoColor, bgColor); err != nil {
+			return err
+		}
+		copied++
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	metrics.Copy("cinemas", copied, copyStart)
+
+	res, err := txn.Exec(`
+		UPDATE cinemas c
+		SET logo_color = COALESCE(i.logo_color, c.logo_color),
+		    bg_color = COALESCE(i.bg_color, c.bg_color)
+		FROM ` + placeColorsImportTable + ` i
+		WHERE c.ya_id = i.ya_id
+		  AND (c.logo_color, c.bg_color) IS DISTINCT FROM
+		      (COALESCE(i.logo_color, c.logo_color), COALESCE(i.bg_color, c.bg_color))`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update cinema colors")
+	}
+
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil {
+		slog.Info("Updated cinema colors", "count", n)
+	}
+	return nil
+}
+
+// loadPlaces loads places of changed place files, and returns files which were loaded
 // XXX: duplicated in crawl
-func loadPlaces() ([]afisha.Place, error) {
+func loadPlaces() ([]afisha.Place, []string, error) {
 	placeFiles, err := filepath.Glob(path.Join(outDir, placesDir, "*"))
 	if err != nil {
-		return nil, errors.Wrap(err, "Place files Glob failed: ")
+		return nil, nil, errors.Wrap(err, "Place files Glob failed: ")
 	}
-	log.Printf("Loading places from %v files", len(placeFiles))
+	placeFiles = changedFiles(placeFiles)
+	slog.Info("Loading places", "files", len(placeFiles))
 
 	var places []afisha.Place
+	var loaded []string
 
 	for _, fn := range placeFiles {
 		var chunk []afisha.Place
 		if err := util.UnmarshalFromFile(fn, &chunk); err != nil {
-			log.Printf("Failed to load file %v, skipping: %v", fn, err)
+			slog.Warn("Failed to load place file, skipping", "file", fn, "err", err)
 			continue
 		}
 
 		places = append(places, chunk...)
+		loaded = append(loaded, fn)
 	}
 
-	return places, nil
+	return places, loaded, nil
 }
 
 func fillPlaces(db *sql.DB) error {
-	places, err := loadPlaces()
+	places, files, err := loadPlaces()
 	if err != nil {
 		return err
 	}
-	log.Printf("Loaded %d places", len(places))
+	slog.Info("Loaded places", "count", len(places))
 
-	citymap := map[string]afisha.City{}
-	tzset := map[string]struct{}{}
-	for _, pl := range places {
-		if _, ok := citymap[pl.City.Name]; !ok {
-			citymap[pl.City.Name] = pl.City
-			tzset[pl.City.TimeZone] = struct{}{}
-		}
+	// Cinemas are referenced by favorites, so places crawl no longer produces are kept,
+	// and their sessions are deleted with their schedules
+	if removed := removedItems("place", placesDir); len(removed) != 0 {
+		slog.Info("Keeping places removed from crawl", "count", len(removed))
 	}
 
-	tzs := make([]string, len(tzset))
-	i := 0
-	for tz := range tzset {
-		tzs[i] = tz
-		i++
-	}
-
-	tzmap, err := tzLoader.GetIDs(tzs)
-	if err != nil {
-		return err
-	}
-
-	if len(tzmap) < len(tzs) {
-		log.Printf("Expected to get %d timezones, but got %d", len(tzs), len(tzmap))
-		for _, tz := range tzs {
-			if _, ok := tzmap[tz]; !ok {
-				log.Printf("TZ missing: %s", tz)
-			}
+	citymap := map[string]afisha.City{}
+	for _, pl := range places {
+		if _, ok := citymap[pl.City.ID]; !ok {
+			citymap[pl.City.ID] = pl.City
 		}
-		return errors.Errorf("Cant find some timezones")
 	}
 
-	log.Printf("Loaded %d timezones", len(tzmap))
-
-	cities := make(CityData, len(citymap))
-	i = 0
+	cities := make([]afisha.City, 0, len(citymap))
 	for _, city := range citymap {
-		var ok bool
-
-		cities[i].CountryCode = [...]byte{'R', 'U'}
-		cities[i].Name = city.Name
-		cities[i].YaName = city.ID
-		cities[i].TimeZoneID, ok = tzmap[city.TimeZone]
-		if !ok {
-			panic(errors.Errorf("Unexpected cache miss for tz: %v", city.TimeZone))
-		}
-		i++
+		cities = append(cities, city)
 	}
 
-	log.Printf("Saving %d cities", len(cities))
-	cityIDmap, err := cityLoader.GetIDsCreating(cities)
+	cityIDmap, err := saveCities(db, cities, false)
 	if err != nil {
 		return err
 	}
@@ -167,18 +234,26 @@ func fillPlaces(db *sql.DB) error {
 			panic(errors.Errorf("Unexpected cache miss for city: %v", pl.City))
 		}
 
+		if !pl.Coordinates.Valid() {
+			slog.Warn("Invalid place coordinates, location won't be saved", "place", pl.ID, "city", pl.City.ID, "latitude", pl.Coordinates.Latitude, "longitude", pl.Coordinates.Longitude)
+		}
+
 		placeDatas = append(placeDatas, PlaceDataItem{
-			CityID:  cid,
-			Name:    pl.Title,
-			Address: pl.Address,
-			Long:    pl.Coordinates.Longitude,
-			Lat:     pl.Coordinates.Latitude,
-			YaID:    pl.ID,
+			CityID:      cid,
+			Name:        pl.Title,
+			Address:     pl.Address,
+			Coordinates: pl.Coordinates,
+			YaID:        pl.ID,
+
+			LogoColor: pl.LogoColor,
+			BGColor:   pl.BGColor,
 		})
 	}
 
+	placeIDmap := map[string]int{}
+
 	const chunkSize = 100
-	log.Printf("Saving %d places in chunks of %d", len(placeDatas), chunkSize)
+	slog.Info("Saving places", "count", len(placeDatas), "chunk", chunkSize)
 	for i := 0; i < len(placeDatas); i += chunkSize {
 		end := i + chunkSize
 
@@ -188,11 +263,28 @@ func fillPlaces(db *sql.DB) error {
 
 		chunk := placeDatas[i:end]
 
-		_, err := placeLoader.GetIDsCreating(chunk)
+		ids, err := placeLoader.GetIDsCreating(chunk)
 		if err != nil {
 			return err
 		}
+
+		for yaID, id := range ids {
+			placeIDmap[yaID] = id
+		}
+	}
+
+	if err := updatePlaceColors(db, placeDatas); err != nil {
+		return err
+	}
+
+	if err := fillPlaceRelations(db, places, placeIDmap, cityIDmap); err != nil {
+		return err
+	}
+
+	if err := fillChains(db, places, chainOverrides); err != nil {
+		return err
 	}
 
+	markFilled(files)
 	return nil
 }
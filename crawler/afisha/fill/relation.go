@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/stek29/kr/crawler/afisha/metrics"
+)
+
+// InsertRelations inserts rows into many-to-many table, ignoring already existing ones
+func InsertRelations(db *sql.DB, table string, fields []string, rows [][]interface{}) error {
+	fieldCnt := len(fields)
+
+	// postgres allows at most 65535 parameters per statement
+	chunkSize := 60000 / fieldCnt
+
+	for i := 0; i < len(rows); i += chunkSize {
+		end := i + chunkSize
+
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		chunk := rows[i:end]
+		parts := make([]string, len(chunk))
+		values := make([]interface{}, 0, len(chunk)*fieldCnt)
+
+		for j, row := range chunk {
+			placeholders := make([]string, fieldCnt)
+			for k := range placeholders {
+				placeholders[k] = fmt.Sprintf("$%d", len(values)+k+1)
+			}
+
+			parts[j] = "(" + strings.Join(placeholders, ", ") + ")"
+			values = append(values, row...)
+		}
+
+		statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", table, strings.Join(fields, ", ")) +
+			strings.Join(parts, ",") +
+			" ON CONFLICT DO NOTHING"
+
+		res, err := db.Exec(statement, values...)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err == nil {
+			metrics.RowsInserted.WithLabelValues(table).Add(float64(n))
+		}
+	}
+
+	return nil
+}
@@ -4,16 +4,20 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/changelog"
+	"github.com/stek29/kr/crawler/afisha/logging"
+	"github.com/stek29/kr/crawler/afisha/metrics"
 	"github.com/stek29/kr/crawler/afisha/util"
 )
 
@@ -24,6 +28,7 @@ const (
 
 type Session struct {
 	Hall     string
+	HallID   int
 	CinemaID int
 	CityID   int
 	EventID  string
@@ -33,6 +38,9 @@ type Session struct {
 	Date     time.Time
 	PriceMin int
 	PriceMax int
+
+	// ObservedAt is time when the session was crawled
+	ObservedAt time.Time
 }
 
 func (s *Session) UniqueKey() string {
@@ -43,15 +51,48 @@ func (s *Session) UniqueKey() string {
 	return fmt.Sprintf("%v;%d;%s;%v", s.Hall, s.CinemaID, s.EventID, s.Date)
 }
 
-func InsertSessions(db *sql.DB, sessions []Session) error {
+// sessionImportTable is a temporary table sessions are copied into before
+// being merged into sessions and session_prices
+const sessionImportTable = "sessions_import"
+
+// sameSession matches known session s with imported session i by ya_id,
+// sessions without ya_id are matched by cinema, hall, movie and time
+const sameSession = `(s.ya_id = i.ya_id OR
+	i.ya_id IS NULL AND s.ya_id IS NULL
+	AND s.cinema_id = i.cinema_id
+	AND s.hall_name IS NOT DISTINCT FROM i.hall_name
+	AND s.movie_id = i.movie_id
+	AND s.date = i.date)`
+
+// InsertSessions saves sessions crawled at observedAt, updating prices of already known ones.
+// Price observations are appended to session_prices whenever they change.
+func InsertSessions(db *sql.DB, observedAt time.Time, sessions []Session) error {
 	txn, err := db.Begin()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`CREATE TEMP TABLE ` + sessionImportTable + ` (
+		hall_name   varchar,
+		hall_id     int,
+		cinema_id   int,
+		city_id     int,
+		movie_id    int,
+		type        int,
+		ya_id       char(32),
+		date        timestamp,
+		price_min   smallint,
+		price_max   smallint
+	) ON COMMIT DROP`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create import table")
 	}
 
 	stmt, err := txn.Prepare(pq.CopyIn(
-		"sessions",
+		sessionImportTable,
 		"hall_name",
+		"hall_id",
 		"cinema_id",
 		"city_id",
 		"movie_id",
@@ -66,18 +107,23 @@ func InsertSessions(db *sql.DB, sessions []Session) error {
 		return err
 	}
 
+	copyStart := time.Now()
 	for _, sess := range sessions {
-		var hall, yaID interface{}
+		var hall, hallID, yaID interface{}
 
 		if sess.Hall != "" {
 			hall = sess.Hall
 		}
+		if sess.HallID != 0 {
+			hallID = sess.HallID
+		}
 		if sess.YaID != "" {
 			yaID = sess.YaID
 		}
 
 		_, err = stmt.Exec(
 			hall,
+			hallID,
 			sess.CinemaID,
 			sess.CityID,
 			sess.MovieID,
@@ -101,21 +147,77 @@ func InsertSessions(db *sql.DB, sessions []Session) error {
 	if err != nil {
 		return err
 	}
+	metrics.Copy("sessions", len(sessions), copyStart)
+
+	// Known sessions: record price only if it differs from the current one,
+	// and the observation is newer than the last recorded one
+	updated, err := txn.Exec(`
+		WITH changed AS (
+			UPDATE sessions s
+			SET price_min = i.price_min,
+			    price_max = i.price_max
+			FROM `+sessionImportTable+` i
+			WHERE `+sameSession+`
+			  AND (s.price_min, s.price_max) IS DISTINCT FROM (i.price_min, i.price_max)
+			  AND NOT EXISTS(
+				SELECT 1
+				FROM session_prices p
+				WHERE p.session_id = s.session_id
+				  AND p.observed_at >= $1::timestamp
+			  )
+			RETURNING s.session_id, s.price_min, s.price_max
+		)
+		INSERT INTO session_prices (session_id, observed_at, price_min, price_max)
+		SELECT session_id, $1::timestamp, price_min, price_max
+		FROM changed
+		ON CONFLICT DO NOTHING`, observedAt)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update session prices")
+	}
+
+	// New sessions: insert them along with first price observation
+	var insertedSessions, insertedPrices int
+	err = txn.QueryRow(`
+		WITH inserted AS (
+			INSERT INTO sessions (hall_name, hall_id, cinema_id, city_id, movie_id, type, ya_id, date, price_min, price_max)
+			SELECT hall_name, hall_id, cinema_id, city_id, movie_id, type, ya_id, date, price_min, price_max
+			FROM `+sessionImportTable+` i
+			WHERE NOT EXISTS(SELECT 1 FROM sessions s WHERE `+sameSession+`)
+			RETURNING session_id, price_min, price_max
+		), prices AS (
+			INSERT INTO session_prices (session_id, observed_at, price_min, price_max)
+			SELECT session_id, $1::timestamp, price_min, price_max
+			FROM inserted
+			ON CONFLICT DO NOTHING
+			RETURNING session_id
+		)
+		SELECT (SELECT count(*) FROM inserted), (SELECT count(*) FROM prices)`, observedAt).Scan(&insertedSessions, &insertedPrices)
+	if err != nil {
+		return errors.Wrap(err, "Failed to insert sessions")
+	}
 
 	err = txn.Commit()
 	if err != nil {
 		return err
 	}
 
+	metrics.RowsInserted.WithLabelValues("sessions").Add(float64(insertedSessions))
+	metrics.RowsInserted.WithLabelValues("session_prices").Add(float64(insertedPrices))
+	if n, err := updated.RowsAffected(); err == nil {
+		metrics.RowsInserted.WithLabelValues("session_prices").Add(float64(n))
+	}
+
 	return nil
 }
 
-func loadSessions(date afisha.Date) ([]Session, error) {
+// loadSessions loads sessions of changed schedule files for date, and returns files which were loaded
+func loadSessions(db *sql.DB, date afisha.Date) ([]Session, []string, error) {
 	sessionFiles, err := filepath.Glob(path.Join(outDir, scheduleDir, date.String(), "*", "*.json"))
 	if err != nil {
-		return nil, errors.Wrap(err, "Session files Glob failed: ")
+		return nil, nil, errors.Wrap(err, "Session files Glob failed: ")
 	}
-	log.Printf("Loading sessions from %d files", len(sessionFiles))
+	sessionFiles = changedFiles(sessionFiles)
+	slog.Info("Loading sessions", "date", date, "files", len(sessionFiles))
 
 	parseSessionFilename := func(fn string) (city, placeID string) {
 		pathItems := strings.Split(fn, string(os.PathSeparator))
@@ -138,17 +240,28 @@ func loadSessions(date afisha.Date) ([]Session, error) {
 
 	placeMap, err := placeLoader.GetIDs(placeIDs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	log.Printf("%d places loaded", len(placeMap))
+	slog.Info("Loaded places", "count", len(placeMap))
 
 	cityMap, err := cityLoader.GetIDs(cities)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	slog.Info("Loaded cities", "count", len(cityMap))
+
+	// Crawl times are recorded in manifest, file mtimes change when outputs are copied
+	manifest, err := changelog.LoadManifest(outDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, nil, errors.Wrap(err, "Failed to load crawl manifest")
+		}
+		manifest = changelog.Manifest{}
 	}
-	log.Printf("%d cities loaded", len(cityMap))
+	mtimeFiles := 0
 
 	var sessions []Session
+	var loaded []string
 
 	yaEvents := map[string]yaEventInfo{}
 
@@ -157,20 +270,42 @@ func loadSessions(date afisha.Date) ([]Session, error) {
 	for _, fn := range sessionFiles {
 		var items []afisha.ScheduleItem
 
+		rel, err := filepath.Rel(outDir, fn)
+		if err != nil {
+			slog.Warn("Unexpected file outside of out dir, skipping", "file", fn, "err", err)
+			continue
+		}
+
+		observedAt, ok := manifest.Crawled(rel)
+		if !ok {
+			// Outputs of crawls which didn't record crawl times only have mtime
+			stat, err := os.Stat(fn)
+			if err != nil {
+				slog.Warn("Failed to stat schedule file, skipping", "file", fn, "err", err)
+				continue
+			}
+			observedAt = stat.ModTime()
+			mtimeFiles++
+		}
+		observedAt = observedAt.UTC()
+
 		if err := util.UnmarshalFromFile(fn, &items); err != nil {
-			log.Printf("Failed to load file %v, skipping: %v", fn, err)
+			slog.Warn("Failed to load schedule file, skipping", "file", fn, "err", err)
 			continue
 		}
 
 		city, placeYaID := parseSessionFilename(fn)
 		placeID, ok := placeMap[placeYaID]
 		if !ok {
-			log.Fatalf("Unexpected placeMap cache miss: %s", placeYaID)
+			// Place might have been added after places were crawled
+			slog.Warn("Unknown place of schedule file, skipping", "file", fn, "place", placeYaID)
+			continue
 		}
 		cityID, ok := cityMap[city]
 		if !ok {
-			log.Fatalf("Unexpected cityMap cache miss: %s", city)
+			logging.Fatal("Unexpected cityMap cache miss", "city", city)
 		}
+		loaded = append(loaded, fn)
 
 		for _, item := range items {
 			for _, sched := range item.Schedule {
@@ -179,8 +314,9 @@ func loadSessions(date afisha.Date) ([]Session, error) {
 				kpID := kpIDFromURL(item.Event.Kinopoisk.URL)
 				if info, ok := yaEvents[eventID]; !ok || (info.kpID == 0 && kpID != 0) {
 					yaEvents[eventID] = yaEventInfo{
-						kpID: kpID,
-						url:  item.Event.URL,
+						kpID:  kpID,
+						url:   item.Event.URL,
+						image: item.Event.Image,
 					}
 				}
 
@@ -199,7 +335,7 @@ func loadSessions(date afisha.Date) ([]Session, error) {
 					if tid := sess.Ticket.ID; tid != "" {
 						ticketIDBytes, err := base64.StdEncoding.DecodeString(tid)
 						if err != nil {
-							log.Printf("Failed to decode ticketID (%s) for event=%s city=%s place=%s, skipping: %v", tid, item.Event.ID, city, placeYaID, err)
+							slog.Warn("Failed to decode ticket ID, skipping", "ticket", tid, "event", item.Event.ID, "city", city, "place", placeYaID, "err", err)
 							continue
 						}
 						ticketID = string(ticketIDBytes)
@@ -207,7 +343,7 @@ func loadSessions(date afisha.Date) ([]Session, error) {
 
 					dateTime, err := time.Parse(afisha.DateTimeLayout, sess.Datetime)
 					if err != nil {
-						log.Printf("Failed to parse date (%s) for event=%s city=%s place=%s, skipping: %v", sess.Datetime, item.Event.ID, city, placeYaID, err)
+						slog.Warn("Failed to parse session time, skipping", "datetime", sess.Datetime, "event", item.Event.ID, "city", city, "place", placeYaID, "err", err)
 						continue
 					}
 
@@ -221,11 +357,13 @@ func loadSessions(date afisha.Date) ([]Session, error) {
 						Date:     dateTime,
 						PriceMin: sess.Ticket.Price.Min,
 						PriceMax: sess.Ticket.Price.Max,
+
+						ObservedAt: observedAt,
 					}
 
 					antiDupeKey := session.UniqueKey()
 					if _, ok := antiDupe[antiDupeKey]; ok {
-						log.Printf("Duplicate session detected, skipping: %v", antiDupeKey)
+						slog.Debug("Duplicate session detected, skipping", "key", antiDupeKey)
 					} else {
 						antiDupe[antiDupeKey] = struct{}{}
 						sessions = append(sessions, session)
@@ -235,50 +373,170 @@ func loadSessions(date afisha.Date) ([]Session, error) {
 		}
 	}
 
-	eventMap, err := loadEvents(yaEvents)
+	if mtimeFiles != 0 {
+		slog.Warn("Crawl time isn't recorded for schedule files, using their mtime", "files", mtimeFiles)
+	}
+
+	eventMap, err := loadEvents(db, yaEvents)
 	if err != nil {
-		log.Printf("Failed to load events!")
-		return nil, err
+		slog.Error("Failed to load events", "err", err)
+		return nil, nil, err
 	}
 
 	for i := range sessions {
 		var ok bool
 		sessions[i].MovieID, ok = eventMap[sessions[i].EventID]
 		if !ok {
-			log.Fatalf("Unexpected eventMap cache miss (%s)", sessions[i].EventID)
+			logging.Fatal("Unexpected eventMap cache miss", "event", sessions[i].EventID)
 		}
 	}
 
-	return sessions, nil
+	if err := loadHalls(sessions); err != nil {
+		slog.Error("Failed to load halls", "err", err)
+		return nil, nil, err
+	}
+
+	return sessions, loaded, nil
 }
 
-func fillSessions(db *sql.DB, dateStr string) error {
-	date, err := afisha.ParseDate(dateStr)
+// removeSessions deletes sessions of schedule items of date which crawl no longer produces.
+// Only sessions after the crawl which noticed removal are deleted, earlier ones have been shown.
+// Units removed by crawl are marked filled once deletions are committed,
+// units which are still there are marked by loadSessions.
+func removeSessions(db *sql.DB, date afisha.Date) error {
+	removed := removedItems("session", path.Join(scheduleDir, date.String()))
+	if len(removed) == 0 {
+		return nil
+	}
+
+	type scheduleItem struct {
+		placeID, eventID string
+		removedAt        time.Time
+	}
+
+	var items []scheduleItem
+	var placeIDs, eventIDs []string
+	for _, c := range removed {
+		// Items are keyed by afisha.ScheduleItemKey
+		parts := strings.Split(c.ID, ";")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			slog.Warn("Unexpected removed schedule item key, skipping", "key", c.ID, "unit", c.Unit)
+			continue
+		}
+		items = append(items, scheduleItem{parts[0], parts[1], c.Time})
+		placeIDs = append(placeIDs, parts[0])
+		eventIDs = append(eventIDs, parts[1])
+	}
+
+	placeMap, err := placeLoader.GetIDs(placeIDs)
+	if err != nil {
+		return err
+	}
+	eventMap, err := eventLoader.GetIDs(eventIDs)
+	if err != nil {
+		return err
+	}
+
+	txn, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	sessions, err := loadSessions(date)
+	defer txn.Rollback()
+
+	// Session dates are local to city
+	stmt, err := txn.Prepare(`
+		DELETE FROM sessions s
+		USING cities ct, timezones tz
+		WHERE ct.city_id = s.city_id
+		  AND tz.timezone_id = ct.timezone_id
+		  AND s.cinema_id = $1
+		  AND s.movie_id = $2
+		  AND s.date >= $3::date
+		  AND s.date < $3::date + 1
+		  AND s.date > ($4::timestamptz AT TIME ZONE tz.name)`)
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
 
-	log.Printf("Loaded %d sessions for date %s", len(sessions), date)
+	var deleted int64
+	for _, item := range items {
+		// Places and events which were never filled have no sessions
+		cinemaID, ok := placeMap[item.placeID]
+		if !ok {
+			continue
+		}
+		movieID, ok := eventMap[item.eventID]
+		if !ok {
+			continue
+		}
 
-	const chunkSize = 1000
-	log.Printf("Saving %d sessions in chunks of %d", len(sessions), chunkSize)
-	for i := 0; i < len(sessions); i += chunkSize {
-		end := i + chunkSize
+		res, err := stmt.Exec(cinemaID, movieID, date.String(), item.removedAt)
+		if err != nil {
+			return errors.Wrap(err, "Failed to delete removed sessions")
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			deleted += n
+		}
+	}
 
-		if end > len(sessions) {
-			end = len(sessions)
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	metrics.RowsDeleted.WithLabelValues("sessions").Add(float64(deleted))
+	slog.Info("Deleted sessions removed from schedules", "count", deleted, "items", len(items), "date", date)
+
+	var files []string
+	seen := map[string]struct{}{}
+	for _, c := range removed {
+		if _, ok := seen[c.Unit]; ok {
+			continue
 		}
+		seen[c.Unit] = struct{}{}
+
+		fn := filepath.Join(outDir, filepath.FromSlash(c.Unit))
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			files = append(files, fn)
+		}
+	}
+	markFilled(files)
+
+	return nil
+}
+
+func fillSessions(db *sql.DB, date afisha.Date) error {
+	// Removed sessions are deleted first, so sessions crawled again after removal are inserted back
+	if err := removeSessions(db, date); err != nil {
+		return err
+	}
+
+	sessions, files, err := loadSessions(db, date)
+	if err != nil {
+		return err
+	}
 
-		chunk := sessions[i:end]
+	slog.Info("Loaded sessions", "count", len(sessions), "date", date)
 
-		err := InsertSessions(db, chunk)
+	// Sessions are saved in chunks crawled at same time
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].ObservedAt.Before(sessions[j].ObservedAt)
+	})
+
+	const chunkSize = 1000
+	slog.Info("Saving sessions", "count", len(sessions), "chunk", chunkSize)
+	for i := 0; i < len(sessions); {
+		end := i + 1
+		for end < len(sessions) && end-i < chunkSize && sessions[end].ObservedAt.Equal(sessions[i].ObservedAt) {
+			end++
+		}
+
+		err := InsertSessions(db, sessions[i].ObservedAt, sessions[i:end])
 		if err != nil {
 			return err
 		}
+		i = end
 	}
+
+	markFilled(files)
 	return nil
 }
@@ -1,10 +1,27 @@
 module github.com/stek29/kr/crawler/afisha
 
-go 1.12
+go 1.21
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
 	github.com/google/go-querystring v1.0.0
 	github.com/lib/pq v1.1.1
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.19.1
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/andybalholm/cascadia v1.0.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -0,0 +1,102 @@
+package afisha
+
+import (
+	"context"
+)
+
+// Iterator iterates over items of paged endpoint page by page.
+// Pages are loaded in background, and next page is only requested once
+// previous one was taken, so callers can persist items as they arrive and
+// stop early with Close.
+type Iterator[T any] struct {
+	pager  Pager[T]
+	cancel context.CancelFunc
+	pages  chan []T
+	err    error
+	closed bool
+
+	items []T
+	item  T
+	seen  map[string]struct{}
+}
+
+// Items starts loading items with pager in background.
+// If opts.Workers is more than one, items are returned in order pages arrive.
+func Items[T any](ctx context.Context, pager Pager[T], offset, limit int, opts PagingOptions) *Iterator[T] {
+	ctx, cancel := context.WithCancel(ctx)
+	it := &Iterator[T]{
+		pager:  pager,
+		cancel: cancel,
+		pages:  make(chan []T),
+		seen:   map[string]struct{}{},
+	}
+
+	go func() {
+		defer close(it.pages)
+
+		it.err = PagingLoadOpts(offset, limit, opts, func(offset, limit int) (*PagingData, int, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+
+			items, data, err := loadPage(ctx, pager, opts, offset, limit)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			select {
+			case it.pages <- items:
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+
+			return data, len(items), nil
+		})
+	}()
+
+	return it
+}
+
+// Next advances to next item, waiting for next page if needed.
+// It returns false when there are no more items or loading failed.
+func (it *Iterator[T]) Next() bool {
+	for {
+		for len(it.items) > 0 {
+			it.item, it.items = it.items[0], it.items[1:]
+
+			key := it.pager.Key(&it.item)
+			if _, ok := it.seen[key]; !ok {
+				it.seen[key] = struct{}{}
+				return true
+			}
+		}
+
+		items, ok := <-it.pages
+		if !ok {
+			return false
+		}
+		it.items = items
+	}
+}
+
+// Item returns current item
+func (it *Iterator[T]) Item() *T {
+	return &it.item
+}
+
+// Err returns error which stopped iteration, if any.
+// It's only valid after Next returned false.
+func (it *Iterator[T]) Err() error {
+	if it.closed {
+		return nil
+	}
+	return it.err
+}
+
+// Close stops loading, it must be called if iteration is stopped early
+func (it *Iterator[T]) Close() {
+	it.closed = true
+	it.cancel()
+	for range it.pages {
+	}
+}
@@ -0,0 +1,315 @@
+// Command kinod runs crawl and fill continuously.
+//
+// For every city places are refreshed daily, repertory hourly and
+// today/tomorrow schedules every few minutes, with intervals picked by
+// city size. Fill runs after each crawl unit with crawl change log, and
+// health and job status are served over HTTP.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/config"
+	"github.com/stek29/kr/crawler/afisha/logging"
+	"github.com/stek29/kr/crawler/afisha/util"
+)
+
+const (
+	placesDir  = "places"
+	reportFile = "report.json"
+)
+
+var (
+	crawlBin string
+	fillBin  string
+	outDir   string
+	connStr  string
+	logOpts  logging.Options
+
+	// storageBackend is passed to crawl and fill, they only support config.StorageFS
+	storageBackend string
+
+	configFile    string
+	crawlArgs     string
+	fillArgs      string
+	scheduleDates string
+
+	largeCityPlaces int
+	sched           *scheduler
+)
+
+// registerFlags registers interval flags of city size with defaults
+func (i *intervals) registerFlags(fs *flag.FlagSet, size citySize, defaults intervals) {
+	fs.DurationVar(&i.Places, size.String()+"-places-interval", defaults.Places, "Places refresh interval of "+size.String()+" cities")
+	fs.DurationVar(&i.Repertory, size.String()+"-repertory-interval", defaults.Repertory, "Repertory refresh interval of "+size.String()+" cities")
+	fs.DurationVar(&i.Schedules, size.String()+"-schedules-interval", defaults.Schedules, "Schedules refresh interval of "+size.String()+" cities")
+}
+
+// sizeOf returns size class of city with n places
+func sizeOf(n int) citySize {
+	if n >= largeCityPlaces {
+		return largeCity
+	}
+	return smallCity
+}
+
+// updateSize sets city size by number of its crawled places
+func updateSize(city string) {
+	var places []json.RawMessage
+	err := util.UnmarshalFromFile(path.Join(outDir, placesDir, city+".json"), &places)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Failed to load city places", "city", city, "err", err)
+		}
+		return
+	}
+
+	sched.setSize(city, sizeOf(len(places)))
+}
+
+// runCommand runs bin with args, passing its output through.
+// If ctx is done, command is asked to stop with SIGTERM.
+func runCommand(ctx context.Context, bin string, args ...string) error {
+	slog.Debug("Running command", "cmd", bin, "args", args)
+
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 30 * time.Second
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%v failed", filepath.Base(bin))
+	}
+	return nil
+}
+
+// writeCityList writes city list file for crawl, it must be removed by caller
+func writeCityList(city string) (string, error) {
+	f, err := os.CreateTemp("", "kinod-city-*.json")
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create city list")
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode([]string{city}); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "Failed to write city list")
+	}
+	return f.Name(), nil
+}
+
+// crawlReport is part of crawl run report checked after crawl
+type crawlReport struct {
+	Requests int64            `json:"requests"`
+	Retries  int64            `json:"retries"`
+	Errors   map[string]int64 `json:"errors"`
+	Error    string           `json:"error"`
+}
+
+// checkCrawlReport fails crawl which got nothing but errors.
+// Crawl skips units it failed to load, so it exits successfully even if Afisha is unreachable.
+func checkCrawlReport() error {
+	var report crawlReport
+	if err := util.UnmarshalFromFile(path.Join(outDir, reportFile), &report); err != nil {
+		return errors.Wrap(err, "Failed to load crawl report")
+	}
+	return report.check()
+}
+
+// check fails report of failed crawl or with nothing but errors.
+// Failed request is counted in errors once after all its retries, and each retry is a request too,
+// so requests which weren't retried all failed if there are as many errors.
+func (r *crawlReport) check() error {
+	if r.Error != "" {
+		return errors.Errorf("Crawl failed: %v", r.Error)
+	}
+
+	var failed int64
+	for _, n := range r.Errors {
+		failed += n
+	}
+	if failed > 0 && failed >= r.Requests-r.Retries {
+		return errors.Errorf("All crawl requests failed: %d errors for %d requests with %d retries", failed, r.Requests, r.Retries)
+	}
+	return nil
+}
+
+// commonArgs are arguments passed to both crawl and fill.
+// Commands read rest of settings from same config and environment.
+func commonArgs() []string {
+	args := []string{
+		"-out", outDir,
+		"-storage-backend", storageBackend,
+		"-afisha-url", afisha.BaseURL,
+		"-log-level", logOpts.Level,
+		"-log-format", logOpts.Format,
+		// Metrics of short-lived commands can't be scraped, kinod serves its own
+		"-metrics-addr", "",
+	}
+	if configFile != "" {
+		args = append(args, "-config", configFile)
+	}
+	return args
+}
+
+func crawl(ctx context.Context, cityList string, args ...string) error {
+	base := append(commonArgs(),
+		"-city-list", cityList,
+	)
+	if err := runCommand(ctx, crawlBin, append(append(base, strings.Fields(crawlArgs)...), args...)...); err != nil {
+		return err
+	}
+	return checkCrawlReport()
+}
+
+// fill fills output of last crawl.
+// Only units changed since fill acknowledged them are filled,
+// so changes of crawls whose fill failed are filled by next run.
+func fill(ctx context.Context, args ...string) error {
+	base := append(commonArgs(), "-conn", connStr, "-changes-only")
+	return runCommand(ctx, fillBin, append(append(base, strings.Fields(fillArgs)...), args...)...)
+}
+
+// runJob crawls job unit for its city, and fills crawled data
+func runJob(ctx context.Context, j *job) error {
+	cityList, err := writeCityList(j.City)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(cityList)
+
+	switch j.Kind {
+	case placesJob:
+		if err := crawl(ctx, cityList, "-do-places"); err != nil {
+			return err
+		}
+		updateSize(j.City)
+		return fill(ctx, "-fill-places")
+
+	case repertoryJob:
+		// Repertories are only read by fill along with sessions,
+		// so there's nothing to fill yet
+		return crawl(ctx, cityList, "-do-city-repertories")
+
+	case schedulesJob:
+		if err := crawl(ctx, cityList, "-do-schedules", scheduleDates); err != nil {
+			return err
+		}
+		return fill(ctx, "-fill-sessions", scheduleDates)
+	}
+
+	return errors.Errorf("Unknown job kind %v", j.Kind)
+}
+
+func main() {
+	configFileFlag := config.RegisterFlags(flag.CommandLine)
+	cityListFile := flag.String("city-list", "", "City list in JSON")
+	cityNames := flag.String("cities", "", "Comma separated city list, used if -city-list isn't set")
+	addr := flag.String("addr", ":8080", "Serve /healthz, /status and /metrics at address")
+
+	flag.StringVar(&crawlBin, "crawl", "crawl", "Path to crawl command")
+	flag.StringVar(&fillBin, "fill", "fill", "Path to fill command")
+	flag.StringVar(&crawlArgs, "crawl-args", "", "Extra crawl arguments, space separated, like -paging-workers 4")
+	flag.StringVar(&fillArgs, "fill-args", "", "Extra fill arguments, space separated")
+	flag.StringVar(&outDir, "out", "", "Crawl result output dir")
+	storageBackendFlag := config.RegisterStorageFlags(flag.CommandLine)
+	flag.StringVar(&connStr, "conn", "", "Postgres connection specifier")
+	flag.StringVar(&afisha.BaseURL, "afisha-url", afisha.BaseURL, "Yandex.Afisha base URL")
+	flag.StringVar(&scheduleDates, "schedule-dates", "today+1", "Dates of refreshed schedules, same format as crawl -do-schedules")
+
+	flag.IntVar(&largeCityPlaces, "large-city-places", 30, "Cities with at least this many places use large city intervals")
+	var small, large intervals
+	small.registerFlags(flag.CommandLine, smallCity, intervals{Places: 24 * time.Hour, Repertory: time.Hour, Schedules: time.Hour})
+	large.registerFlags(flag.CommandLine, largeCity, intervals{Places: 24 * time.Hour, Repertory: time.Hour, Schedules: 15 * time.Minute})
+	retryDelay := flag.Duration("retry-delay", 5*time.Minute, "Delay before failed job is retried, unless its interval is shorter")
+	maxFailing := flag.Int("max-failing", 3, "Report unhealthy if any job failed this many times in a row")
+
+	logOpts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	// Config file is passed to crawl and fill too
+	configFile = *configFileFlag
+	if err := config.Setup(flag.CommandLine, configFile); err != nil {
+		logging.Fatal("Invalid config", "err", err)
+	}
+	storageBackend = *storageBackendFlag
+
+	if _, err := logOpts.Setup(); err != nil {
+		logging.Fatal("Invalid logging flags", "err", err)
+	}
+
+	if outDir == "" {
+		logging.Fatal("-out is required")
+	}
+	if connStr == "" {
+		logging.Fatal("-conn is required")
+	}
+	if *cityListFile == "" && *cityNames == "" {
+		logging.Fatal("-city-list or -cities is required")
+	}
+
+	if _, err := afisha.ParseDates(scheduleDates, afisha.Today()); err != nil {
+		logging.Fatal("Invalid schedule-dates", "dates", scheduleDates, "err", err)
+	}
+
+	for _, bin := range []*string{&crawlBin, &fillBin} {
+		resolved, err := exec.LookPath(*bin)
+		if err != nil {
+			logging.Fatal("Command not found", "cmd", *bin, "err", err)
+		}
+		*bin = resolved
+	}
+
+	var cities []string
+	if *cityListFile != "" {
+		if err := util.UnmarshalFromFile(*cityListFile, &cities); err != nil {
+			logging.Fatal("Failed to load city list", "file", *cityListFile, "err", err)
+		}
+	} else {
+		cities = strings.Split(*cityNames, ",")
+	}
+	slog.Info("Loaded city list", "count", len(cities))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sched = newScheduler(runJob, map[citySize]intervals{smallCity: small, largeCity: large}, *retryDelay)
+	sched.add(cities)
+	for _, city := range cities {
+		updateSize(city)
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: statusHandler(sched, time.Now(), *maxFailing)}
+	go func() {
+		slog.Info("Serving status", "addr", *addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logging.Fatal("Status server failed", "addr", *addr, "err", err)
+		}
+	}()
+
+	sched.Run(ctx)
+
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Failed to shut down status server", "err", err)
+	}
+}
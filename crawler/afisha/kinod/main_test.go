@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCrawlReportCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		report crawlReport
+		fail   bool
+	}{
+		{"no requests", crawlReport{}, false},
+		{"no errors", crawlReport{Requests: 10, Retries: 1, Errors: map[string]int64{}}, false},
+		{"some failed", crawlReport{Requests: 10, Retries: 2, Errors: map[string]int64{"http_503": 1, "timeout": 1}}, false},
+		{"all failed after retries", crawlReport{Requests: 6, Retries: 4, Errors: map[string]int64{"http_503": 2}}, true},
+		{"all failed without retries", crawlReport{Requests: 3, Errors: map[string]int64{"network": 3}}, true},
+		{"crawl failed", crawlReport{Requests: 10, Errors: map[string]int64{}, Error: "stopped by terminated"}, true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.report.check(); (err != nil) != tt.fail {
+			t.Errorf("%s: check() = %v, want failure %v", tt.name, err, tt.fail)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stek29/kr/crawler/afisha/metrics"
+)
+
+// jobKind is kind of crawl unit refreshed by job
+type jobKind int
+
+const (
+	placesJob jobKind = iota
+	repertoryJob
+	schedulesJob
+)
+
+func (k jobKind) String() string {
+	switch k {
+	case placesJob:
+		return "places"
+	case repertoryJob:
+		return "repertory"
+	case schedulesJob:
+		return "schedules"
+	default:
+		return "unknown"
+	}
+}
+
+// citySize is size class of city, it picks refresh intervals of city jobs
+type citySize int
+
+const (
+	smallCity citySize = iota
+	largeCity
+)
+
+func (s citySize) String() string {
+	if s == largeCity {
+		return "large"
+	}
+	return "small"
+}
+
+// intervals are refresh intervals of job kinds
+type intervals struct {
+	Places    time.Duration
+	Repertory time.Duration
+	Schedules time.Duration
+}
+
+func (i intervals) of(kind jobKind) time.Duration {
+	switch kind {
+	case placesJob:
+		return i.Places
+	case repertoryJob:
+		return i.Repertory
+	default:
+		return i.Schedules
+	}
+}
+
+// job refreshes one kind of crawl unit for a city
+type job struct {
+	Kind jobKind `json:"-"`
+	City string  `json:"city"`
+
+	Next         time.Time     `json:"next"`
+	LastRun      time.Time     `json:"last_run,omitempty"`
+	LastDuration time.Duration `json:"last_duration,omitempty"`
+	LastError    string        `json:"last_error,omitempty"`
+	Runs         int           `json:"runs"`
+	Failures     int           `json:"failures"`
+	// Failing is number of consecutive failed runs
+	Failing int `json:"failing"`
+}
+
+// jobStatus is job state reported by status endpoint
+type jobStatus struct {
+	Job  string `json:"job"`
+	Size string `json:"size"`
+	job
+	LastDuration string `json:"last_duration,omitempty"`
+}
+
+// runFunc runs job, it's called by scheduler one job at a time
+type runFunc func(ctx context.Context, j *job) error
+
+// scheduler runs jobs one by one as they become due.
+// Jobs never run concurrently, since crawl and fill share output dir and change log.
+type scheduler struct {
+	run runFunc
+	now func() time.Time
+
+	// intervals are refresh intervals by city size
+	intervals map[citySize]intervals
+	// retryDelay is delay before failed job is retried, if less than its interval
+	retryDelay time.Duration
+
+	mu      sync.Mutex
+	jobs    []*job
+	sizes   map[string]citySize
+	running *job
+	// wake interrupts waiting for next job, used when city size changes
+	wake chan struct{}
+}
+
+func newScheduler(run runFunc, ivs map[citySize]intervals, retryDelay time.Duration) *scheduler {
+	return &scheduler{
+		run:        run,
+		now:        time.Now,
+		intervals:  ivs,
+		retryDelay: retryDelay,
+		sizes:      map[string]citySize{},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// add adds jobs of all kinds for cities, all of them due now.
+// Places are refreshed before repertories, and repertories before schedules.
+func (s *scheduler) add(cities []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for _, kind := range []jobKind{placesJob, repertoryJob, schedulesJob} {
+		for _, city := range cities {
+			s.jobs = append(s.jobs, &job{Kind: kind, City: city, Next: now})
+		}
+	}
+}
+
+// setSize sets size class of city, rescheduling its jobs if their intervals changed
+func (s *scheduler) setSize(city string, size citySize) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, known := s.sizes[city]
+	s.sizes[city] = size
+	if !known || prev == size {
+		return
+	}
+
+	slog.Info("City size changed", "city", city, "size", size.String())
+	for _, j := range s.jobs {
+		if j.City != city || j.LastRun.IsZero() {
+			continue
+		}
+		if next := j.LastRun.Add(s.intervals[size].of(j.Kind)); next.Before(j.Next) {
+			j.Next = next
+		}
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns job due first and its due time,
+// jobs with same due time run in order they were added
+func (s *scheduler) next() (*job, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first *job
+	for _, j := range s.jobs {
+		if first == nil || j.Next.Before(first.Next) {
+			first = j
+		}
+	}
+	if first == nil {
+		return nil, time.Time{}
+	}
+	return first, first.Next
+}
+
+// finish records job run result and schedules its next run, which is returned
+func (s *scheduler) finish(j *job, started time.Time, err error) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	j.LastRun = started
+	j.LastDuration = now.Sub(started)
+	j.Runs++
+
+	interval := s.intervals[s.sizes[j.City]].of(j.Kind)
+	result := "ok"
+	if err != nil {
+		result = "error"
+		j.LastError = err.Error()
+		j.Failures++
+		j.Failing++
+		if s.retryDelay > 0 && s.retryDelay < interval {
+			interval = s.retryDelay
+		}
+	} else {
+		j.LastError = ""
+		j.Failing = 0
+	}
+	j.Next = started.Add(interval)
+	if j.Next.Before(now) {
+		// Job took longer than its interval, don't let it starve other jobs
+		j.Next = now
+	}
+
+	metrics.JobRuns.WithLabelValues(j.Kind.String(), result).Inc()
+	metrics.JobDuration.WithLabelValues(j.Kind.String()).Observe(j.LastDuration.Seconds())
+
+	return j.Next
+}
+
+// Run runs jobs until ctx is done
+func (s *scheduler) Run(ctx context.Context) {
+	for {
+		j, due := s.next()
+		if j == nil {
+			<-ctx.Done()
+			return
+		}
+
+		if wait := due.Sub(s.now()); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				timer.Stop()
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		s.mu.Lock()
+		s.running = j
+		s.mu.Unlock()
+
+		log := slog.With("job", j.Kind.String(), "city", j.City)
+		log.Info("Running job")
+
+		started := s.now()
+		err := s.run(ctx, j)
+		if ctx.Err() != nil {
+			log.Info("Job interrupted", "err", err)
+			return
+		}
+		next := s.finish(j, started, err)
+		duration := s.now().Sub(started).Round(time.Millisecond)
+
+		s.mu.Lock()
+		s.running = nil
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Error("Job failed", "duration", duration, "next", next, "err", err)
+		} else {
+			log.Info("Job finished", "duration", duration, "next", next)
+		}
+	}
+}
+
+// status returns copy of jobs states sorted by due time, and currently running job
+func (s *scheduler) status() (jobs []jobStatus, running *jobStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		st := jobStatus{Job: j.Kind.String(), Size: s.sizes[j.City].String(), job: *j}
+		if j.Runs > 0 {
+			st.LastDuration = j.LastDuration.Round(time.Millisecond).String()
+		}
+		jobs = append(jobs, st)
+		if j == s.running {
+			running = &st
+		}
+	}
+
+	sort.SliceStable(jobs, func(a, b int) bool {
+		return jobs[a].Next.Before(jobs[b].Next)
+	})
+
+	return jobs, running
+}
+
+// unhealthy returns jobs failed at least maxFailing times in a row
+func (s *scheduler) unhealthy(maxFailing int) []jobStatus {
+	jobs, _ := s.status()
+
+	var res []jobStatus
+	for _, j := range jobs {
+		if j.Failing >= maxFailing {
+			res = append(res, j)
+		}
+	}
+	return res
+}
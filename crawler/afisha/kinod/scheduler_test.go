@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testIntervals = map[citySize]intervals{
+	smallCity: {Places: 24 * time.Hour, Repertory: time.Hour, Schedules: time.Hour},
+	largeCity: {Places: 24 * time.Hour, Repertory: time.Hour, Schedules: 15 * time.Minute},
+}
+
+// newTestScheduler makes scheduler with clock which is only moved by tests
+func newTestScheduler(run runFunc) (*scheduler, *time.Time) {
+	now := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	s := newScheduler(run, testIntervals, 5*time.Minute)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	var ran []string
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, _ := newTestScheduler(func(ctx context.Context, j *job) error {
+		ran = append(ran, j.Kind.String()+" "+j.City)
+		if len(ran) == 6 {
+			cancel()
+		}
+		return nil
+	})
+	s.add([]string{"moscow", "kazan"})
+	s.Run(ctx)
+
+	want := []string{
+		"places moscow", "places kazan",
+		"repertory moscow", "repertory kazan",
+		"schedules moscow", "schedules kazan",
+	}
+	if strings.Join(ran, ",") != strings.Join(want, ",") {
+		t.Errorf("Jobs ran in order %v, want %v", ran, want)
+	}
+}
+
+func TestSchedulerFinish(t *testing.T) {
+	s, now := newTestScheduler(nil)
+	s.add([]string{"moscow"})
+	s.setSize("moscow", largeCity)
+
+	j, _ := s.next()
+	started := *now
+	*now = now.Add(time.Minute)
+
+	if next := s.finish(j, started, nil); !next.Equal(started.Add(24 * time.Hour)) {
+		t.Errorf("Places job is scheduled at %v, want in 24h", next)
+	}
+
+	sch := s.jobs[2]
+	if next := s.finish(sch, started, nil); !next.Equal(started.Add(15 * time.Minute)) {
+		t.Errorf("Large city schedules job is scheduled at %v, want in 15m", next)
+	}
+
+	// Failed jobs are retried sooner
+	if next := s.finish(sch, started, errors.New("captcha")); !next.Equal(started.Add(5 * time.Minute)) {
+		t.Errorf("Failed job is scheduled at %v, want in 5m", next)
+	}
+	if sch.Failing != 1 || sch.LastError != "captcha" {
+		t.Errorf("Unexpected failed job state: %+v", sch)
+	}
+
+	// Jobs taking longer than interval are due right away
+	*now = started.Add(time.Hour)
+	if next := s.finish(sch, started, nil); !next.Equal(*now) {
+		t.Errorf("Slow job is scheduled at %v, want now", next)
+	}
+	if sch.Failing != 0 || sch.LastError != "" || sch.Runs != 3 || sch.Failures != 1 {
+		t.Errorf("Unexpected job state: %+v", sch)
+	}
+}
+
+func TestSchedulerSetSize(t *testing.T) {
+	s, now := newTestScheduler(nil)
+	s.add([]string{"moscow"})
+	s.setSize("moscow", smallCity)
+
+	sch := s.jobs[2]
+	started := *now
+	s.finish(sch, started, nil)
+
+	s.setSize("moscow", largeCity)
+	if !sch.Next.Equal(started.Add(15 * time.Minute)) {
+		t.Errorf("Schedules job is not rescheduled for large city: %v", sch.Next)
+	}
+
+	// Jobs aren't postponed when city becomes smaller
+	s.setSize("moscow", smallCity)
+	if !sch.Next.Equal(started.Add(15 * time.Minute)) {
+		t.Errorf("Schedules job is postponed for small city: %v", sch.Next)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	s, now := newTestScheduler(nil)
+	s.add([]string{"moscow"})
+	h := statusHandler(s, *now, 2)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected healthy, got %d: %v", rec.Code, rec.Body)
+	}
+
+	sch := s.jobs[2]
+	s.finish(sch, *now, errors.New("timeout"))
+	s.finish(sch, *now, errors.New("timeout"))
+
+	rec := get("/healthz")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "schedules moscow failed 2 times") {
+		t.Errorf("Expected unhealthy, got %d: %v", rec.Code, rec.Body)
+	}
+
+	var report statusReport
+	if err := json.NewDecoder(get("/status").Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Jobs) != 3 || report.Running != nil {
+		t.Errorf("Unexpected status: %+v", report)
+	}
+}
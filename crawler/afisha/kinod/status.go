@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/stek29/kr/crawler/afisha/metrics"
+)
+
+// statusReport is served by /status
+type statusReport struct {
+	Started time.Time   `json:"started"`
+	Running *jobStatus  `json:"running"`
+	Jobs    []jobStatus `json:"jobs"`
+}
+
+// statusHandler serves health, status and metrics of scheduler
+func statusHandler(s *scheduler, started time.Time, maxFailing int) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		failing := s.unhealthy(maxFailing)
+		if len(failing) == 0 {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, j := range failing {
+			fmt.Fprintf(w, "%v %v failed %d times in a row: %v\n", j.Job, j.City, j.Failing, j.LastError)
+		}
+	})
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		report := statusReport{Started: started}
+		report.Jobs, report.Running = s.status()
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			slog.Warn("Failed to write status", "err", err)
+		}
+	})
+
+	mux.Handle("/metrics", metrics.Handler())
+
+	return mux
+}
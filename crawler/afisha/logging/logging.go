@@ -0,0 +1,73 @@
+// Package logging sets up structured leveled logger shared by crawl and fill.
+//
+// Log records use same attribute names everywhere:
+// city, place, event, date, file, table and err.
+package logging
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Options are logger options set with flags
+type Options struct {
+	// Level is one of debug, info, warn or error
+	Level string
+	// Format is text or json
+	Format string
+}
+
+// RegisterFlags registers -log-level and -log-format flags
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Level, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.StringVar(&o.Format, "log-format", "text", "Log format: text or json")
+}
+
+// Setup makes logger writing to stderr and sets it as default
+func (o Options) Setup() (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+		return nil, errors.Errorf("Invalid log level: `%v`", o.Level)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceErrors}
+
+	var handler slog.Handler
+	switch strings.ToLower(o.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, handlerOpts)
+	default:
+		return nil, errors.Errorf("Invalid log format: `%v`", o.Format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// replaceErrors logs errors by their messages, since handlers format them
+// with %+v, which includes stack traces of github.com/pkg/errors errors
+func replaceErrors(groups []string, a slog.Attr) slog.Attr {
+	if err, ok := a.Value.Any().(error); ok {
+		a.Value = slog.StringValue(err.Error())
+	}
+	return a
+}
+
+// Fatal logs msg with error level and exits.
+// It might be called before Setup, so errors are replaced with their messages here too.
+func Fatal(msg string, args ...any) {
+	for i, arg := range args {
+		if err, ok := arg.(error); ok {
+			args[i] = err.Error()
+		}
+	}
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
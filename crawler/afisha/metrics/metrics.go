@@ -0,0 +1,171 @@
+// Package metrics exposes Prometheus metrics of crawl and fill runs
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// RequestDuration is afisha request latency by endpoint
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "afisha_request_duration_seconds",
+		Help:    "Afisha request latency by endpoint.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"endpoint"})
+
+	// Responses counts afisha responses by endpoint and HTTP status code
+	Responses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "afisha_responses_total",
+		Help: "Afisha responses by endpoint and HTTP status code, code is error for failed requests.",
+	}, []string{"endpoint", "code"})
+
+	// Retries counts retried page requests
+	Retries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "afisha_retries_total",
+		Help: "Retried afisha page requests.",
+	})
+
+	// CaptchaHits counts responses with captcha instead of data
+	CaptchaHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "afisha_captcha_total",
+		Help: "Afisha responses with captcha page instead of data.",
+	})
+
+	// CacheLookups counts loader cache lookups by table and result (hit or miss)
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loader_cache_lookups_total",
+		Help: "Loader ID cache lookups by table and result.",
+	}, []string{"table", "result"})
+
+	// RowsInserted counts inserted rows by table
+	RowsInserted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_rows_inserted_total",
+		Help: "Rows inserted by table.",
+	}, []string{"table"})
+
+	// RowsDeleted counts deleted rows by table
+	RowsDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_rows_deleted_total",
+		Help: "Rows deleted by table.",
+	}, []string{"table"})
+
+	// CopyRows counts rows sent with COPY by table
+	CopyRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_copy_rows_total",
+		Help: "Rows sent with COPY by table.",
+	}, []string{"table"})
+
+	// CopyDuration is COPY duration by table
+	CopyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_copy_duration_seconds",
+		Help:    "COPY duration by table.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"table"})
+
+	// JobRuns counts kinod job runs by job kind and result (ok or error)
+	JobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kinod_job_runs_total",
+		Help: "Daemon job runs by job kind and result.",
+	}, []string{"job", "result"})
+
+	// JobDuration is kinod job duration by job kind
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kinod_job_duration_seconds",
+		Help:    "Daemon job duration by job kind.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"job"})
+)
+
+// idRegexp matches afisha object IDs in URL paths
+var idRegexp = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+// pageEndpoint is endpoint label of all non-API paths, like event pages,
+// so they don't make a label each
+const pageEndpoint = "/:page"
+
+// Endpoint makes endpoint label from API URL path, replacing IDs with :id.
+// Paths outside of API are labeled as /:page.
+func Endpoint(urlPath string) string {
+	if !strings.HasPrefix(strings.TrimPrefix(urlPath, "/"), "api/") {
+		return pageEndpoint
+	}
+
+	var parts []string
+	for _, part := range strings.Split(urlPath, "/") {
+		switch {
+		case part == "":
+			continue
+		case idRegexp.MatchString(part):
+			parts = append(parts, ":id")
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// transport instruments requests with metrics
+type transport struct {
+	base http.RoundTripper
+}
+
+// Transport wraps base to record request latency, status codes and captcha hits
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return transport{base}
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := Endpoint(req.URL.Path)
+	start := time.Now()
+
+	resp, err := t.base.RoundTrip(req)
+	RequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		Responses.WithLabelValues(endpoint, "error").Inc()
+		return nil, err
+	}
+
+	Responses.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+
+	// API responds with HTML captcha page instead of JSON when it suspects a bot
+	isAPI := strings.HasPrefix(req.URL.Path, "/api/")
+	if isAPI && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		resp.Request != nil && strings.Contains(resp.Request.URL.Path, "captcha") {
+		CaptchaHits.Inc()
+	}
+
+	return resp, nil
+}
+
+// Copy records count rows sent with COPY into table since start
+func Copy(table string, count int, start time.Time) {
+	CopyRows.WithLabelValues(table).Add(float64(count))
+	CopyDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+}
+
+// Handler serves metrics in Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve starts serving metrics at addr in background
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	go func() {
+		slog.Info("Serving metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics server failed", "addr", addr, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stek29/kr/crawler/afisha"
+	"github.com/stek29/kr/crawler/afisha/afishatest"
+)
+
+func TestEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"/api/events/cinema/places":                            "/api/events/cinema/places",
+		"/api/places/5575f2a9cc1c725c1f8c6c01/schedule_cinema": "/api/places/:id/schedule_cinema",
+		"api/events/5c6f0e9a1e2fdb0d1f3c2b01":                  "/api/events/:id",
+		"/moscow/cinema/aladdin":                               "/:page",
+		"/apiary/cinema":                                       "/:page",
+	}
+	for path, want := range tests {
+		if got := Endpoint(path); got != want {
+			t.Errorf("Endpoint(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	s := afishatest.NewServer()
+	defer s.Close()
+
+	prev := afisha.BaseURL
+	afisha.BaseURL = s.BaseURL()
+	defer func() { afisha.BaseURL = prev }()
+
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+	endpoint := "/api/events/cinema/places"
+
+	if _, err := afisha.GetPlaces(client, &afisha.PlacesParams{City: "moscow"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(Responses.WithLabelValues(endpoint, "200")); n != 1 {
+		t.Errorf("Expected 1 OK response, got %v", n)
+	}
+
+	s.SetCaptcha(true)
+	afisha.GetPlaces(client, &afisha.PlacesParams{City: "moscow"})
+	if n := testutil.ToFloat64(CaptchaHits); n != 1 {
+		t.Errorf("Expected 1 captcha hit, got %v", n)
+	}
+}
@@ -0,0 +1,107 @@
+package afisha
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Pager loads pages of paged endpoint
+type Pager[T any] interface {
+	// Page loads page of up to limit items at offset
+	Page(ctx context.Context, offset, limit int) ([]T, *PagingData, error)
+	// Key identifies item, items with same key are only returned once
+	Key(item *T) string
+}
+
+// PageFunc loads page of up to limit items at offset
+type PageFunc[T any] func(ctx context.Context, offset, limit int) ([]T, *PagingData, error)
+
+type funcPager[T any] struct {
+	page PageFunc[T]
+	key  func(item *T) string
+}
+
+func (p funcPager[T]) Page(ctx context.Context, offset, limit int) ([]T, *PagingData, error) {
+	return p.page(ctx, offset, limit)
+}
+
+func (p funcPager[T]) Key(item *T) string {
+	return p.key(item)
+}
+
+// NewPager makes Pager from page loading and item key functions
+func NewPager[T any](page PageFunc[T], key func(item *T) string) Pager[T] {
+	return funcPager[T]{page, key}
+}
+
+// loadPage calls pager.Page retrying failed requests as configured by opts
+func loadPage[T any](ctx context.Context, pager Pager[T], opts PagingOptions, offset, limit int) ([]T, *PagingData, error) {
+	for attempt := 0; ; attempt++ {
+		items, data, err := pager.Page(ctx, offset, limit)
+		if err == nil || attempt >= opts.Retries || ctx.Err() != nil {
+			return items, data, err
+		}
+
+		delay := opts.RetryDelay << uint(attempt)
+		logger().Warn("Failed to load page, retrying", "offset", offset, "delay", delay, "err", err)
+		if opts.OnRetry != nil {
+			opts.OnRetry(err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// FetchAll loads all items with pager.
+// Pages are assembled in offset order even if loaded concurrently.
+func FetchAll[T any](ctx context.Context, pager Pager[T], offset, limit int, opts PagingOptions) ([]T, error) {
+	var mu sync.Mutex
+	pages := map[int][]T{}
+
+	err := PagingLoadOpts(offset, limit, opts, func(offset, limit int) (*PagingData, int, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		items, data, err := loadPage(ctx, pager, opts, offset, limit)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		mu.Lock()
+		pages[offset] = items
+		mu.Unlock()
+
+		return data, len(items), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int, 0, len(pages))
+	for offset := range pages {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	var result []T
+	seen := map[string]struct{}{}
+	for _, offset := range offsets {
+		for _, item := range pages[offset] {
+			key := pager.Key(&item)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			result = append(result, item)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,99 @@
+package afisha
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// intPager pages over 0..total-1, failing first failures requests
+type intPager struct {
+	total    int
+	failures int
+	calls    int
+}
+
+func (p *intPager) Page(ctx context.Context, offset, limit int) ([]int, *PagingData, error) {
+	p.calls++
+	if p.failures > 0 {
+		p.failures--
+		return nil, nil, errors.New("failure")
+	}
+
+	var items []int
+	for i := offset; i < p.total && i < offset+limit; i++ {
+		items = append(items, i)
+	}
+	return items, &PagingData{Limit: limit, Offset: offset, Total: p.total}, nil
+}
+
+func (p *intPager) Key(item *int) string {
+	return strconv.Itoa(*item)
+}
+
+func TestFetchAll(t *testing.T) {
+	items, err := FetchAll[int](context.Background(), &intPager{total: 25}, 0, 10, PagingOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 25 || items[0] != 0 || items[24] != 24 {
+		t.Errorf("Unexpected items: %v", items)
+	}
+}
+
+func TestFetchAllRetries(t *testing.T) {
+	p := &intPager{total: 5, failures: 2}
+	if _, err := FetchAll[int](context.Background(), p, 0, 10, PagingOptions{Retries: 1}); err == nil {
+		t.Errorf("Expected error with not enough retries")
+	}
+
+	p = &intPager{total: 5, failures: 2}
+	items, err := FetchAll[int](context.Background(), p, 0, 10, PagingOptions{Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 5 || p.calls != 3 {
+		t.Errorf("Expected 5 items in 3 calls, got %d in %d", len(items), p.calls)
+	}
+}
+
+func TestFetchAllCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := &intPager{total: 5}
+	if _, err := FetchAll[int](ctx, p, 0, 10, PagingOptions{}); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if p.calls != 0 {
+		t.Errorf("Expected no calls, got %d", p.calls)
+	}
+}
+
+func TestItemsDedupe(t *testing.T) {
+	// Every page starts with previous page's last item
+	p := NewPager(func(ctx context.Context, offset, limit int) ([]int, *PagingData, error) {
+		var items []int
+		for i := offset - 1; i < 10 && i < offset+limit-1; i++ {
+			if i >= 0 {
+				items = append(items, i)
+			}
+		}
+		return items, &PagingData{Limit: limit, Total: 10}, nil
+	}, func(item *int) string {
+		return strconv.Itoa(*item)
+	})
+
+	it := Items(context.Background(), p, 0, 4, PagingOptions{})
+	var items []int
+	for it.Next() {
+		items = append(items, *it.Item())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 10 {
+		t.Errorf("Expected 10 unique items, got %v", items)
+	}
+}
@@ -1,6 +1,9 @@
 package afisha
 
 import (
+	"sync"
+	"time"
+
 	"github.com/pkg/errors"
 )
 
@@ -11,34 +14,184 @@ type PagingData struct {
 	Total  int `json:"total"`
 }
 
+// PagingOptions tune PagingLoad behaviour
+type PagingOptions struct {
+	// MaxItems caps number of loaded items, zero means no cap
+	MaxItems int
+	// Workers is number of pages loaded concurrently once Total is known.
+	// PagingFunc must be safe for concurrent use if it's more than one.
+	Workers int
+
+	// Retries is number of retries of failed page requests, used by FetchAll and Items
+	Retries int
+	// RetryDelay is delay before first retry, it's doubled on each next one
+	RetryDelay time.Duration
+	// OnRetry is called before every retry if set, it must be safe for concurrent use
+	OnRetry func(err error)
+}
+
 // PagingFunc is callback for PagingLoad
 type PagingFunc func(offset int, limit int) (*PagingData, int, error)
 
-// ErrUnexpectedStop is returned if count is zero while there are still results to load
+// ErrUnexpectedStop is returned if count is zero while there are still results to load,
+// or if page loaded concurrently is shorter than its limit before the last page
 var ErrUnexpectedStop = errors.New("Unexpected Zero count")
 
+// DefaultPageLimit is used if neither caller nor API provide positive limit
+const DefaultPageLimit = 20
+
 // PagingLoad keeps calling eval with adjusted paging params until all results are loaded
 func PagingLoad(offset, limit int, eval PagingFunc) error {
-	data, cnt, err := eval(offset, limit)
+	return PagingLoadOpts(offset, limit, PagingOptions{}, eval)
+}
+
+// pagingState tracks PagingLoadOpts progress
+type pagingState struct {
+	start  int
+	offset int
+	limit  int
+	total  int
+	opts   PagingOptions
+}
+
+// stop is offset loading should stop at
+func (s *pagingState) stop() int {
+	if s.opts.MaxItems > 0 && s.start+s.opts.MaxItems < s.total {
+		return s.start + s.opts.MaxItems
+	}
+	return s.total
+}
+
+// pageLimit is limit for page at offset, so MaxItems isn't exceeded
+func (s *pagingState) pageLimit(offset int) int {
+	if s.opts.MaxItems > 0 && offset+s.limit > s.start+s.opts.MaxItems {
+		return s.start + s.opts.MaxItems - offset
+	}
+	return s.limit
+}
+
+// update applies page returned by eval.
+// Total is re-read on every page, and only positive limits are trusted.
+func (s *pagingState) update(data *PagingData) {
+	if data.Limit > 0 {
+		s.limit = data.Limit
+	}
+	s.total = data.Total
+}
+
+// PagingLoadOpts is PagingLoad with options.
+//
+// If Total changes while loading, items might be skipped or duplicated,
+// so callers should deduplicate loaded items.
+func PagingLoadOpts(offset, limit int, opts PagingOptions, eval PagingFunc) error {
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+
+	s := pagingState{
+		start:  offset,
+		offset: offset,
+		limit:  limit,
+		opts:   opts,
+	}
+
+	// Total is unknown yet, so MaxItems is applied by hand
+	if opts.MaxItems > 0 && s.limit > opts.MaxItems {
+		s.limit = opts.MaxItems
+	}
+
+	data, cnt, err := eval(s.offset, s.limit)
 	if err != nil {
 		return err
 	}
+	s.update(data)
+	s.offset += cnt
 
-	limit = data.Limit
-	offset += cnt
+	if opts.Workers > 1 && s.offset < s.stop() {
+		if err := s.loadConcurrently(eval); err != nil {
+			return err
+		}
+	}
 
-	for offset < data.Total {
-		data, cnt, err = eval(offset, limit)
+	for s.offset < s.stop() {
+		data, cnt, err = eval(s.offset, s.pageLimit(s.offset))
 		if err != nil {
 			return err
 		}
+
+		s.update(data)
+
 		if cnt == 0 {
-			return ErrUnexpectedStop
+			// Total might have decreased since last page
+			if s.offset < s.stop() {
+				return ErrUnexpectedStop
+			}
+			break
+		}
+
+		s.offset += cnt
+	}
+
+	return nil
+}
+
+// loadConcurrently loads all pages up to current stop using opts.Workers goroutines,
+// and then moves offset to the stop
+func (s *pagingState) loadConcurrently(eval PagingFunc) error {
+	stop := s.stop()
+
+	offsets := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		total    = s.total
+		limit    = s.limit
+	)
+
+	for i := 0; i < s.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for offset := range offsets {
+				pageLimit := s.pageLimit(offset)
+				data, cnt, err := eval(offset, pageLimit)
+
+				mu.Lock()
+				switch {
+				case err != nil && firstErr == nil:
+					firstErr = err
+				// Short page in the middle leaves gap before next page, which is loaded by other worker
+				case err == nil && cnt < pageLimit && offset+cnt < data.Total && offset+cnt < stop && firstErr == nil:
+					firstErr = ErrUnexpectedStop
+				case err == nil && data.Total > total:
+					total = data.Total
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for offset := s.offset; offset < stop; offset += limit {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
 		}
 
-		limit = data.Limit
-		offset += cnt
+		offsets <- offset
+	}
+	close(offsets)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
 	}
 
+	// Items added while loading are picked up sequentially
+	s.offset = stop
+	s.total = total
 	return nil
 }
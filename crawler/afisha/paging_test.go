@@ -0,0 +1,229 @@
+package afisha
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakePages serves total items with server side limit
+type fakePages struct {
+	total      int
+	limit      int
+	calls      []int
+	zeroOffset int
+	// shortOffset page has only shortCount items, if set
+	shortOffset int
+	shortCount  int
+}
+
+func (p *fakePages) eval(offset, limit int) (*PagingData, int, error) {
+	p.calls = append(p.calls, offset)
+
+	if limit == 0 || limit > p.limit {
+		limit = p.limit
+	}
+
+	cnt := p.total - offset
+	if cnt > limit {
+		cnt = limit
+	}
+	if cnt < 0 || (p.zeroOffset != 0 && offset >= p.zeroOffset) {
+		cnt = 0
+	}
+	if p.shortOffset != 0 && offset == p.shortOffset && cnt > p.shortCount {
+		cnt = p.shortCount
+	}
+
+	return &PagingData{Limit: limit, Offset: offset, Total: p.total}, cnt, nil
+}
+
+func TestPagingLoad(t *testing.T) {
+	tests := []struct {
+		name   string
+		total  int
+		limit  int
+		offset int
+		calls  []int
+	}{
+		{"empty", 0, 20, 0, []int{0}},
+		{"single page", 5, 20, 0, []int{0}},
+		{"exact pages", 40, 20, 0, []int{0, 20}},
+		{"partial last page", 45, 20, 0, []int{0, 20, 40}},
+		{"start offset", 45, 20, 10, []int{10, 30}},
+		{"offset past total", 5, 20, 10, []int{10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &fakePages{total: tt.total, limit: tt.limit}
+			if err := PagingLoad(tt.offset, tt.limit, p.eval); err != nil {
+				t.Fatal(err)
+			}
+			if !equalInts(p.calls, tt.calls) {
+				t.Errorf("Expected calls at %v, got %v", tt.calls, p.calls)
+			}
+		})
+	}
+}
+
+func TestPagingLoadServerLimit(t *testing.T) {
+	// Server returns less than requested, next pages must use server limit
+	p := &fakePages{total: 25, limit: 10}
+	if err := PagingLoad(0, 100, p.eval); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 10, 20}; !equalInts(p.calls, want) {
+		t.Errorf("Expected calls at %v, got %v", want, p.calls)
+	}
+}
+
+func TestPagingLoadUnexpectedStop(t *testing.T) {
+	p := &fakePages{total: 50, limit: 20, zeroOffset: 20}
+	if err := PagingLoad(0, 20, p.eval); err != ErrUnexpectedStop {
+		t.Errorf("Expected ErrUnexpectedStop, got %v", err)
+	}
+}
+
+func TestPagingLoadError(t *testing.T) {
+	failure := errors.New("failure")
+	calls := 0
+
+	err := PagingLoad(0, 20, func(offset, limit int) (*PagingData, int, error) {
+		calls++
+		if offset >= 20 {
+			return nil, 0, failure
+		}
+		return &PagingData{Limit: 20, Total: 100}, 20, nil
+	})
+
+	if err != failure {
+		t.Errorf("Expected failure, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected to stop after 2 calls, got %d", calls)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPagingLoadZeroLimit(t *testing.T) {
+	calls := 0
+	err := PagingLoad(0, 0, func(offset, limit int) (*PagingData, int, error) {
+		calls++
+		if calls > 10 {
+			t.Fatal("PagingLoad doesn't stop")
+		}
+		if limit <= 0 {
+			t.Fatalf("Expected positive limit, got %d", limit)
+		}
+
+		cnt := 30 - offset
+		if cnt > limit {
+			cnt = limit
+		}
+		return &PagingData{Limit: 0, Offset: offset, Total: 30}, cnt, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 calls, got %d", calls)
+	}
+}
+
+func TestPagingLoadTotalDrift(t *testing.T) {
+	// Total shrinks while loading, last page is empty
+	p := &fakePages{total: 50, limit: 20}
+	err := PagingLoad(0, 20, func(offset, limit int) (*PagingData, int, error) {
+		if offset >= 20 {
+			p.total = 35
+		}
+		return p.eval(offset, limit)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 20}; !equalInts(p.calls, want) {
+		t.Errorf("Expected calls at %v, got %v", want, p.calls)
+	}
+
+	// Total grows while loading
+	p = &fakePages{total: 30, limit: 20}
+	err = PagingLoad(0, 20, func(offset, limit int) (*PagingData, int, error) {
+		if offset >= 20 {
+			p.total = 45
+		}
+		return p.eval(offset, limit)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 20, 40}; !equalInts(p.calls, want) {
+		t.Errorf("Expected calls at %v, got %v", want, p.calls)
+	}
+}
+
+func TestPagingLoadMaxItems(t *testing.T) {
+	p := &fakePages{total: 100, limit: 20}
+	loaded := 0
+	err := PagingLoadOpts(0, 20, PagingOptions{MaxItems: 30}, func(offset, limit int) (*PagingData, int, error) {
+		data, cnt, err := p.eval(offset, limit)
+		loaded += cnt
+		return data, cnt, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 30 {
+		t.Errorf("Expected 30 items, got %d", loaded)
+	}
+}
+
+func TestPagingLoadWorkers(t *testing.T) {
+	var mu sync.Mutex
+	p := &fakePages{total: 95, limit: 10}
+	err := PagingLoadOpts(0, 10, PagingOptions{Workers: 4}, func(offset, limit int) (*PagingData, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return p.eval(offset, limit)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Ints(p.calls)
+	if want := []int{0, 10, 20, 30, 40, 50, 60, 70, 80, 90}; !equalInts(p.calls, want) {
+		t.Errorf("Expected calls at %v, got %v", want, p.calls)
+	}
+}
+
+func TestPagingLoadWorkersShortPage(t *testing.T) {
+	var mu sync.Mutex
+	loaded := 0
+
+	// Page at 30 has 4 items instead of 10, items 34..39 would be lost
+	p := &fakePages{total: 95, limit: 10, shortOffset: 30, shortCount: 4}
+	err := PagingLoadOpts(0, 10, PagingOptions{Workers: 4}, func(offset, limit int) (*PagingData, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, cnt, err := p.eval(offset, limit)
+		loaded += cnt
+		return data, cnt, err
+	})
+	if err != ErrUnexpectedStop {
+		t.Errorf("Expected ErrUnexpectedStop, got %v after loading %d items", err, loaded)
+	}
+}
@@ -0,0 +1,111 @@
+// Package query holds read-only queries to kino database used by services
+package query
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha"
+)
+
+// ErrInvalidCoordinates is returned if lat/lon are out of range
+var ErrInvalidCoordinates = errors.New("Invalid coordinates")
+
+// Cinema is a cinema with distance to requested point
+type Cinema struct {
+	ID        int
+	Name      string
+	Address   string
+	CityID    int
+	Latitude  float64
+	Longitude float64
+	// Distance in meters
+	Distance float64
+}
+
+// cinemas.loc is point(longitude, latitude), $1 is latitude and $2 is longitude
+const (
+	// 6371000 is mean Earth radius in meters
+	haversineDistance = `2 * 6371000 * asin(sqrt(
+		power(sin(radians(c.loc[1] - $1) / 2), 2) +
+		cos(radians($1)) * cos(radians(c.loc[1])) * power(sin(radians(c.loc[0] - $2) / 2), 2)
+	))`
+
+	postgisDistance = `ST_Distance(
+		ST_SetSRID(ST_MakePoint(c.loc[0], c.loc[1]), 4326)::geography,
+		ST_SetSRID(ST_MakePoint($2, $1), 4326)::geography
+	)`
+)
+
+var (
+	postgisMu      sync.Mutex
+	postgisChecked bool
+	hasPostgis     bool
+)
+
+func distanceExpr(db *sql.DB) (string, error) {
+	postgisMu.Lock()
+	defer postgisMu.Unlock()
+
+	if !postgisChecked {
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM pg_extension WHERE extname = 'postgis')`).Scan(&hasPostgis)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to check for postgis")
+		}
+		postgisChecked = true
+	}
+
+	if hasPostgis {
+		return postgisDistance, nil
+	}
+	return haversineDistance, nil
+}
+
+// NearestCinemas returns cinemas closest to given point ordered by distance.
+// radius is in meters, and is ignored if not positive, as is limit.
+// Geography functions of PostGIS are used if it's installed.
+func NearestCinemas(db *sql.DB, lat, lon, radius float64, limit int) ([]Cinema, error) {
+	if !afisha.ValidCoordinates(lat, lon) {
+		return nil, ErrInvalidCoordinates
+	}
+
+	distance, err := distanceExpr(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var radiusArg, limitArg interface{}
+	if radius > 0 {
+		radiusArg = radius
+	}
+	if limit > 0 {
+		limitArg = limit
+	}
+
+	rows, err := db.Query(`
+		SELECT cinema_id, name, address, city_id, loc[1], loc[0], distance
+		FROM (
+			SELECT c.*, `+distance+` AS distance
+			FROM cinemas c
+			WHERE c.loc IS NOT NULL
+		) c
+		WHERE $3::float8 IS NULL OR distance <= $3
+		ORDER BY distance
+		LIMIT $4`, lat, lon, radiusArg, limitArg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Cinema
+	for rows.Next() {
+		var c Cinema
+		if err := rows.Scan(&c.ID, &c.Name, &c.Address, &c.CityID, &c.Latitude, &c.Longitude, &c.Distance); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,146 @@
+//go:build integration
+// +build integration
+
+package query
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// testSchema keeps tables of query tests apart from e2e tests sharing KINO_TEST_DB
+const testSchema = "query_test"
+
+// openTestDB recreates testSchema in database referred by KINO_TEST_DB with kino schema,
+// and returns connection using it
+func openTestDB(t *testing.T) *sql.DB {
+	connStr := os.Getenv("KINO_TEST_DB")
+	if connStr == "" {
+		t.Skip("KINO_TEST_DB is not set")
+	}
+
+	u, err := url.Parse(connStr)
+	if err != nil {
+		t.Fatalf("KINO_TEST_DB must be URL: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", testSchema)
+	u.RawQuery = q.Encode()
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := ioutil.ReadFile("../../../schema/kino.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statements := []string{
+		`DROP SCHEMA IF EXISTS ` + testSchema + ` CASCADE`,
+		`CREATE SCHEMA ` + testSchema,
+		string(schema),
+		`INSERT INTO timezones (name, utc_offset) VALUES ('Europe/Moscow', '3 hours')`,
+		`INSERT INTO countries (country_code, name_ru, name_en) VALUES ('RU', 'Россия', 'Russia')`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Failed to prepare database: %v", err)
+		}
+	}
+
+	return db
+}
+
+func TestNearestCinemas(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	var cityID int
+	err := db.QueryRow(`
+		INSERT INTO cities (country_code, name, ya_name, timezone_id)
+		SELECT 'RU', 'Москва', 'moscow', timezone_id FROM timezones WHERE name = 'Europe/Moscow'
+		RETURNING city_id`).Scan(&cityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Inserted farthest first, so results aren't ordered by id by accident
+	_, err = db.Exec(`
+		INSERT INTO cinemas (name, address, city_id, loc) VALUES
+			('Аврора', 'Невский проспект, 60', $1, point(30.3440, 59.9340)),
+			('Пионер', 'Кутузовский проспект, 21', $1, point(37.5450, 55.7470)),
+			('Художественный', 'Арбатская площадь, 14', $1, point(37.6010, 55.7520)),
+			('Ударник', 'улица Серафимовича, 2', $1, point(37.6110, 55.7430)),
+			('Без координат', 'улица Неизвестная, 1', $1, NULL)`, cityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(cinemas []Cinema) []string {
+		var result []string
+		for _, c := range cinemas {
+			result = append(result, c.Name)
+		}
+		return result
+	}
+
+	// Red Square, Художественный is about 1.26km away and Ударник about 1.36km
+	const lat, lon = 55.7539, 37.6208
+
+	for _, c := range []struct {
+		name   string
+		radius float64
+		limit  int
+		want   []string
+	}{
+		{"all", 0, 0, []string{"Художественный", "Ударник", "Пионер", "Аврора"}},
+		{"radius", 3000, 0, []string{"Художественный", "Ударник"}},
+		{"radius cutoff", 1300, 0, []string{"Художественный"}},
+		{"limit", 0, 3, []string{"Художественный", "Ударник", "Пионер"}},
+		{"nothing in radius", 100, 0, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cinemas, err := NearestCinemas(db, lat, lon, c.radius, c.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := names(cinemas)
+			if len(got) != len(c.want) {
+				t.Fatalf("Got cinemas %v, want %v", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("Got cinemas %v, want %v", got, c.want)
+				}
+			}
+
+			for i, cinema := range cinemas {
+				if c.radius > 0 && cinema.Distance > c.radius {
+					t.Errorf("%v is %.0fm away, outside of %.0fm radius", cinema.Name, cinema.Distance, c.radius)
+				}
+				if i > 0 && cinema.Distance < cinemas[i-1].Distance {
+					t.Errorf("%v is closer than previous %v", cinema.Name, cinemas[i-1].Name)
+				}
+			}
+		})
+	}
+
+	cinemas, err := NearestCinemas(db, lat, lon, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cinemas[0].Distance; d < 1200 || d > 1300 {
+		t.Errorf("Unexpected distance to %v: %.0fm", cinemas[0].Name, d)
+	}
+	if cinemas[0].Latitude != 55.7520 || cinemas[0].Longitude != 37.6010 {
+		t.Errorf("Coordinates are swapped: %v, %v", cinemas[0].Latitude, cinemas[0].Longitude)
+	}
+}
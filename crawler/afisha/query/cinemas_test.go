@@ -0,0 +1,12 @@
+package query
+
+import "testing"
+
+func TestNearestCinemasInvalidCoordinates(t *testing.T) {
+	// Invalid coordinates are rejected before database is queried
+	for _, c := range [][2]float64{{0, 0}, {91, 0}, {0, -181}} {
+		if _, err := NearestCinemas(nil, c[0], c[1], 0, 0); err != ErrInvalidCoordinates {
+			t.Errorf("NearestCinemas(%v, %v) error is %v, want %v", c[0], c[1], err, ErrInvalidCoordinates)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package afisha
+
+import (
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimited delays requests to stay within limiter rate
+type rateLimited struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+// RateLimited wraps base to send at most perSecond requests per second.
+// base is returned as is if perSecond isn't positive.
+func RateLimited(base http.RoundTripper, perSecond float64) http.RoundTripper {
+	if perSecond <= 0 {
+		return base
+	}
+	return rateLimited{base, rate.NewLimiter(rate.Limit(perSecond), 1)}
+}
+
+func (t rateLimited) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
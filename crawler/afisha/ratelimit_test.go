@@ -0,0 +1,33 @@
+package afisha
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimited(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: RateLimited(http.DefaultTransport, 20)}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// First request is sent right away, next ones wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected requests to be rate limited, took %v", elapsed)
+	}
+
+	if RateLimited(http.DefaultTransport, 0) != http.DefaultTransport {
+		t.Errorf("Expected no limit for zero rate")
+	}
+}
@@ -0,0 +1,150 @@
+// Package replay provides http.RoundTripper which records real responses
+// to fixture files and replays them offline, for use in tests
+package replay
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mode is Transport operation mode
+type Mode int
+
+const (
+	// Replay serves responses from fixture files, failing on missing ones
+	Replay Mode = iota
+	// Record makes real requests and saves responses to fixture files
+	Record
+)
+
+// Fixture is recorded response
+type Fixture struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+}
+
+// Transport is record/replay http.RoundTripper
+type Transport struct {
+	// Dir holds fixture files
+	Dir  string
+	Mode Mode
+	// Base makes real requests in Record mode, http.DefaultTransport is used if nil
+	Base http.RoundTripper
+}
+
+// Client returns http.Client using the transport
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+var unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// FixtureName is name of fixture file for request,
+// readable part is followed by hash of full URL to avoid collisions
+func FixtureName(req *http.Request) string {
+	u := req.URL.String()
+	sum := sha1.Sum([]byte(req.Method + " " + u))
+
+	readable := unsafeChars.ReplaceAllString(req.URL.Host+req.URL.Path, "_")
+	readable = strings.Trim(readable, "_")
+	if len(readable) > 80 {
+		readable = readable[:80]
+	}
+
+	return strings.ToLower(req.Method) + "_" + readable + "_" + hex.EncodeToString(sum[:])[:10] + ".json"
+}
+
+// RoundTrip conforms to http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fn := filepath.Join(t.Dir, FixtureName(req))
+
+	if t.Mode == Record {
+		return t.record(req, fn)
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, errors.Errorf("No fixture for %s %s (%s), record it first", req.Method, req.URL, fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fx Fixture
+	if err := json.Unmarshal(data, &fx); err != nil {
+		return nil, errors.Wrapf(err, "Failed to load fixture %s", fn)
+	}
+
+	return fx.response(req), nil
+}
+
+func (t *Transport) record(req *http.Request, fn string) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	fx := Fixture{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     http.Header{},
+		Body:       string(body),
+	}
+	// Only keep headers which affect decoding, cookies and such are not needed
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		fx.Header.Set("Content-Type", ct)
+	}
+
+	if err := os.MkdirAll(t.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(fx, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fn, data, 0644); err != nil {
+		return nil, err
+	}
+
+	return fx.response(req), nil
+}
+
+func (fx *Fixture) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(fx.StatusCode),
+		StatusCode:    fx.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        fx.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(fx.Body))),
+		ContentLength: int64(len(fx.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,70 @@
+package replay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "secret=1")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(`{"q":"` + r.URL.Query().Get("q") + `"}`))
+	}))
+	defer srv.Close()
+
+	get := func(tr *Transport, url string) (int, string) {
+		resp, err := tr.Client().Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Header.Get("Set-Cookie") != "" {
+			t.Errorf("Set-Cookie header shouldn't be recorded")
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	rec := &Transport{Dir: dir, Mode: Record}
+	get(rec, srv.URL+"/a?q=1")
+	get(rec, srv.URL+"/a?q=2")
+
+	if hits != 2 {
+		t.Fatalf("Expected 2 real requests, got %d", hits)
+	}
+
+	rep := &Transport{Dir: dir, Mode: Replay}
+	for _, q := range []string{"1", "2"} {
+		status, body := get(rep, srv.URL+"/a?q="+q)
+		if status != http.StatusTeapot {
+			t.Errorf("Replayed status is %d", status)
+		}
+		if want := `{"q":"` + q + `"}`; body != want {
+			t.Errorf("Replayed body is %s, want %s", body, want)
+		}
+	}
+
+	if hits != 2 {
+		t.Errorf("Replay made real requests")
+	}
+
+	if _, err := rep.Client().Get(srv.URL + "/missing"); err == nil {
+		t.Errorf("Expected error for missing fixture")
+	}
+}
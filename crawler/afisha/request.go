@@ -1,20 +1,41 @@
 package afisha
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 
 	"github.com/google/go-querystring/query"
 )
 
-const (
-	apiBaseURL = "https://afisha.yandex.ru/api/"
-)
+// Logger is used by API client, slog.Default() if nil
+var Logger *slog.Logger
+
+func logger() *slog.Logger {
+	if Logger != nil {
+		return Logger
+	}
+	return slog.Default()
+}
+
+// BaseURL is Yandex.Afisha site URL, API is expected under api/.
+// It's only changed to point at fake servers in tests.
+var BaseURL = "https://afisha.yandex.ru/"
 
-func request(client *http.Client, endpoint string, params interface{}, resp interface{}) error {
-	u, err := url.Parse(apiBaseURL + endpoint)
+// StatusError is returned by API requests answered with error status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Status code is %d", e.StatusCode)
+}
+
+func request(ctx context.Context, client *http.Client, endpoint string, params interface{}, resp interface{}) error {
+	u, err := url.Parse(BaseURL + "api/" + endpoint)
 	if err != nil {
 		return err
 	}
@@ -25,11 +46,12 @@ func request(client *http.Client, endpoint string, params interface{}, resp inte
 	}
 	u.RawQuery = q.Encode()
 
-	log.Printf("INFO: Fetching URL: `%v`", u)
+	logger().Debug("Fetching URL", "url", u.String())
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		return err
 	}
+	req = req.WithContext(ctx)
 
 	r, err := client.Do(req)
 	if err != nil {
@@ -37,6 +59,10 @@ func request(client *http.Client, endpoint string, params interface{}, resp inte
 	}
 	defer r.Body.Close()
 
+	if r.StatusCode >= 400 {
+		return &StatusError{r.StatusCode}
+	}
+
 	dec := json.NewDecoder(r.Body)
 	if err := dec.Decode(&resp); err != nil {
 		return err
@@ -0,0 +1,298 @@
+// Package rudate parses human readable dates and date ranges found on Yandex.Afisha pages,
+// like "5 июня 2019", "с 5 по 12 июня" or "June 5, 2019"
+package rudate
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/stek29/kr/crawler/afisha"
+)
+
+// Range is inclusive date range, Start equals End for single dates
+type Range struct {
+	Start afisha.Date
+	End   afisha.Date
+}
+
+// IsSingle reports if range is a single day
+func (r Range) IsSingle() bool {
+	return r.Start == r.End
+}
+
+// months maps every known month spelling to month
+var months = map[string]time.Month{}
+
+func init() {
+	forms := []struct {
+		month time.Month
+		words []string
+	}{
+		{time.January, []string{"январь", "января", "январе", "янв", "january", "jan"}},
+		{time.February, []string{"февраль", "февраля", "феврале", "фев", "february", "feb"}},
+		{time.March, []string{"март", "марта", "марте", "мар", "march", "mar"}},
+		{time.April, []string{"апрель", "апреля", "апреле", "апр", "april", "apr"}},
+		{time.May, []string{"май", "мая", "мае", "may"}},
+		{time.June, []string{"июнь", "июня", "июне", "июн", "june", "jun"}},
+		{time.July, []string{"июль", "июля", "июле", "июл", "july", "jul"}},
+		{time.August, []string{"август", "августа", "августе", "авг", "august", "aug"}},
+		{time.September, []string{"сентябрь", "сентября", "сентябре", "сен", "сент", "september", "sep", "sept"}},
+		{time.October, []string{"октябрь", "октября", "октябре", "окт", "october", "oct"}},
+		{time.November, []string{"ноябрь", "ноября", "ноябре", "ноя", "november", "nov"}},
+		{time.December, []string{"декабрь", "декабря", "декабре", "дек", "december", "dec"}},
+	}
+
+	for _, f := range forms {
+		for _, w := range f.words {
+			months[w] = f.month
+		}
+	}
+}
+
+// rangeStarts are skipped, rangeSeps split range in two parts, noise is ignored
+var (
+	rangeStarts = map[string]struct{}{"с": {}, "со": {}, "от": {}, "from": {}}
+	rangeSeps   = map[string]struct{}{"по": {}, "до": {}, "to": {}, "till": {}, "until": {}, "-": {}}
+	noise       = map[string]struct{}{"г": {}, "год": {}, "года": {}, "в": {}, "of": {}}
+)
+
+// tokenize splits value to lowercase words and numbers, dashes become "-"
+func tokenize(value string) []string {
+	value = strings.ToLower(value)
+	value = strings.Replace(value, "ё", "е", -1)
+
+	var tokens []string
+	var cur []rune
+	flush := func() {
+		if len(cur) != 0 {
+			tokens = append(tokens, string(cur))
+			cur = cur[:0]
+		}
+	}
+
+	for _, r := range value {
+		switch {
+		case r == '-' || r == '–' || r == '—':
+			flush()
+			tokens = append(tokens, "-")
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			// split "5июня" and "2019г"
+			if len(cur) != 0 && unicode.IsDigit(cur[len(cur)-1]) != unicode.IsDigit(r) {
+				flush()
+			}
+			cur = append(cur, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// partial is date with possibly missing parts
+type partial struct {
+	day   int
+	month time.Month
+	year  int
+}
+
+func parsePartial(tokens []string) (partial, error) {
+	var p partial
+
+	for _, tok := range tokens {
+		if _, ok := noise[tok]; ok {
+			continue
+		}
+
+		if m, ok := months[tok]; ok {
+			if p.month != 0 {
+				return p, errors.Errorf("Duplicate month %s", tok)
+			}
+			p.month = m
+			continue
+		}
+
+		// English ordinals: 1st, 2nd, 3rd, 5th
+		switch tok {
+		case "st", "nd", "rd", "th":
+			continue
+		}
+
+		n, err := strconv.Atoi(tok)
+		if err != nil {
+			return p, errors.Errorf("Unexpected word %s", tok)
+		}
+
+		switch {
+		case n >= 1000 && p.year == 0:
+			p.year = n
+		case n >= 1 && n <= 31 && p.day == 0:
+			p.day = n
+		default:
+			return p, errors.Errorf("Unexpected number %s", tok)
+		}
+	}
+
+	return p, nil
+}
+
+func makeDate(year int, month time.Month, day int) (afisha.Date, error) {
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	if t.Day() != day {
+		return afisha.Date{}, errors.Errorf("Day %d is out of range for %v %d", day, month, year)
+	}
+	return afisha.MakeDate(year, month, day), nil
+}
+
+// nearestYear picks year for month and day so date is closest to ref
+func nearestYear(month time.Month, day int, ref time.Time) int {
+	best := ref.Year()
+	var bestDiff time.Duration = -1
+
+	for year := ref.Year() - 1; year <= ref.Year()+1; year++ {
+		diff := time.Date(year, month, day, 0, 0, 0, 0, ref.Location()).Sub(ref)
+		if diff < 0 {
+			diff = -diff
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = year, diff
+		}
+	}
+
+	return best
+}
+
+// Parse parses date or date range.
+// Missing year is chosen so the date is nearest to ref,
+// and month without a day means whole month.
+func Parse(value string, ref time.Time) (Range, error) {
+	tokens := tokenize(value)
+
+	if len(tokens) != 0 {
+		if _, ok := rangeStarts[tokens[0]]; ok {
+			tokens = tokens[1:]
+		}
+	}
+
+	var parts [][]string
+	start := 0
+	for i, tok := range tokens {
+		if _, ok := rangeSeps[tok]; ok {
+			parts = append(parts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, tokens[start:])
+
+	switch len(parts) {
+	case 1:
+		return parseSingle(parts[0], ref)
+	case 2:
+		return parseRange(parts[0], parts[1], ref)
+	default:
+		return Range{}, errors.Errorf("Can't parse %q: too many range separators", value)
+	}
+}
+
+func parseSingle(tokens []string, ref time.Time) (Range, error) {
+	p, err := parsePartial(tokens)
+	if err != nil {
+		return Range{}, err
+	}
+
+	if p.month == 0 {
+		return Range{}, errors.New("Month is missing")
+	}
+
+	if p.day == 0 {
+		if p.year == 0 {
+			p.year = nearestYear(p.month, 1, ref)
+		}
+
+		first := afisha.MakeDate(p.year, p.month, 1)
+		last := afisha.Date(time.Time(first).AddDate(0, 1, -1))
+		return Range{Start: first, End: last}, nil
+	}
+
+	if p.year == 0 {
+		p.year = nearestYear(p.month, p.day, ref)
+	}
+
+	d, err := makeDate(p.year, p.month, p.day)
+	if err != nil {
+		return Range{}, err
+	}
+	return Range{Start: d, End: d}, nil
+}
+
+func parseRange(left, right []string, ref time.Time) (Range, error) {
+	from, err := parsePartial(left)
+	if err != nil {
+		return Range{}, errors.Wrap(err, "Failed to parse range start")
+	}
+
+	to, err := parsePartial(right)
+	if err != nil {
+		return Range{}, errors.Wrap(err, "Failed to parse range end")
+	}
+
+	if from.day == 0 || to.day == 0 {
+		return Range{}, errors.New("Day is missing in range")
+	}
+
+	// "с 5 по 12 июня": month and year are only set in the end
+	if to.month == 0 {
+		to.month = from.month
+	}
+	if from.month == 0 {
+		from.month = to.month
+	}
+	if from.month == 0 {
+		return Range{}, errors.New("Month is missing")
+	}
+
+	if to.year == 0 && from.year != 0 {
+		to.year = from.year
+		if to.month < from.month {
+			to.year++
+		}
+	}
+	if to.year == 0 {
+		to.year = nearestYear(to.month, to.day, ref)
+	}
+	if from.year == 0 {
+		from.year = to.year
+		// "с 20 декабря по 10 января 2020"
+		if from.month > to.month {
+			from.year--
+		}
+	}
+
+	start, err := makeDate(from.year, from.month, from.day)
+	if err != nil {
+		return Range{}, err
+	}
+	end, err := makeDate(to.year, to.month, to.day)
+	if err != nil {
+		return Range{}, err
+	}
+
+	if time.Time(end).Before(time.Time(start)) {
+		return Range{}, errors.Errorf("Range end %v is before start %v", end, start)
+	}
+
+	return Range{Start: start, End: end}, nil
+}
+
+// ParseDate parses single date, range start is returned for ranges
+func ParseDate(value string, ref time.Time) (afisha.Date, error) {
+	r, err := Parse(value, ref)
+	if err != nil {
+		return afisha.Date{}, err
+	}
+	return r.Start, nil
+}
@@ -0,0 +1,94 @@
+package rudate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stek29/kr/crawler/afisha"
+)
+
+var ref = time.Date(2019, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value string
+		start afisha.Date
+		end   afisha.Date
+	}{
+		// Premiere dates from event pages
+		{"27 июня 2019", afisha.MakeDate(2019, time.June, 27), afisha.MakeDate(2019, time.June, 27)},
+		{"1 мая 2019", afisha.MakeDate(2019, time.May, 1), afisha.MakeDate(2019, time.May, 1)},
+		{"30 мая 2019", afisha.MakeDate(2019, time.May, 30), afisha.MakeDate(2019, time.May, 30)},
+		{"3 марта 2019", afisha.MakeDate(2019, time.March, 3), afisha.MakeDate(2019, time.March, 3)},
+		{"14 февраля 2019 г.", afisha.MakeDate(2019, time.February, 14), afisha.MakeDate(2019, time.February, 14)},
+		{"20 декабря 2018 года", afisha.MakeDate(2018, time.December, 20), afisha.MakeDate(2018, time.December, 20)},
+		{"  12 Сентября 2019 ", afisha.MakeDate(2019, time.September, 12), afisha.MakeDate(2019, time.September, 12)},
+		{"5июня 2019г", afisha.MakeDate(2019, time.June, 5), afisha.MakeDate(2019, time.June, 5)},
+
+		// Missing year is nearest to ref
+		{"13 июня", afisha.MakeDate(2019, time.June, 13), afisha.MakeDate(2019, time.June, 13)},
+		{"28 декабря", afisha.MakeDate(2018, time.December, 28), afisha.MakeDate(2018, time.December, 28)},
+
+		// Nominative month means whole month
+		{"Июнь 2019", afisha.MakeDate(2019, time.June, 1), afisha.MakeDate(2019, time.June, 30)},
+		{"в феврале 2020", afisha.MakeDate(2020, time.February, 1), afisha.MakeDate(2020, time.February, 29)},
+
+		// Ranges
+		{"с 5 по 12 июня", afisha.MakeDate(2019, time.June, 5), afisha.MakeDate(2019, time.June, 12)},
+		{"с 30 мая по 5 июня 2019", afisha.MakeDate(2019, time.May, 30), afisha.MakeDate(2019, time.June, 5)},
+		{"с 20 декабря по 10 января 2020", afisha.MakeDate(2019, time.December, 20), afisha.MakeDate(2020, time.January, 10)},
+		{"с 25 декабря 2019 по 5 января", afisha.MakeDate(2019, time.December, 25), afisha.MakeDate(2020, time.January, 5)},
+		{"5–12 июня 2019", afisha.MakeDate(2019, time.June, 5), afisha.MakeDate(2019, time.June, 12)},
+		{"5 - 12 июня", afisha.MakeDate(2019, time.June, 5), afisha.MakeDate(2019, time.June, 12)},
+
+		// English pages
+		{"June 27, 2019", afisha.MakeDate(2019, time.June, 27), afisha.MakeDate(2019, time.June, 27)},
+		{"27 June 2019", afisha.MakeDate(2019, time.June, 27), afisha.MakeDate(2019, time.June, 27)},
+		{"May 1st", afisha.MakeDate(2019, time.May, 1), afisha.MakeDate(2019, time.May, 1)},
+		{"from June 5 to June 12, 2019", afisha.MakeDate(2019, time.June, 5), afisha.MakeDate(2019, time.June, 12)},
+		{"Sept 2019", afisha.MakeDate(2019, time.September, 1), afisha.MakeDate(2019, time.September, 30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			r, err := Parse(tt.value, ref)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.value, err)
+			}
+			if r.Start != tt.start || r.End != tt.end {
+				t.Errorf("Parse(%q) = %v..%v, want %v..%v", tt.value, r.Start, r.End, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"2019",
+		"31 июня 2019",
+		"5 мартобря 2019",
+		"с 12 по 5 июня 2019",
+		"с 5 по 12",
+		"1 - 2 - 3 июня",
+		"45 мая",
+	}
+
+	for _, value := range tests {
+		t.Run(value, func(t *testing.T) {
+			if r, err := Parse(value, ref); err == nil {
+				t.Errorf("Parse(%q) = %v..%v, want error", value, r.Start, r.End)
+			}
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	d, err := ParseDate("с 5 по 12 июня 2019", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := afisha.MakeDate(2019, time.June, 5); d != want {
+		t.Errorf("ParseDate returned %v, want %v", d, want)
+	}
+}
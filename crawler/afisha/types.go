@@ -23,6 +23,69 @@ type Event struct {
 	Title         string             `json:"title"`
 	OriginalTitle string             `json:"originalTitle"`
 	Kinopoisk     KinopoiskScoreData `json:"kinopoisk"`
+	// Image is event poster
+	Image Image `json:"image,omitempty"`
+}
+
+// ImageSize is a single rendition of an image
+type ImageSize struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// Image holds renditions of an image keyed by their names, like "source" or "eventCover"
+type Image map[string]ImageSize
+
+// UnmarshalJSON conforms to json.Unmarshaler, skipping non-rendition keys like "bgColor"
+func (img *Image) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	res := Image{}
+	for name, value := range raw {
+		var size ImageSize
+		if err := json.Unmarshal(value, &size); err != nil || size.URL == "" {
+			continue
+		}
+		res[name] = size
+	}
+
+	*img = res
+	return nil
+}
+
+// Trailer is event video trailer
+type Trailer struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Premiere is event premiere date in specific region
+type Premiere struct {
+	Region string `json:"region"`
+	Date   Date   `json:"date"`
+}
+
+// EventDetails is full event data returned by GetEvent
+type EventDetails struct {
+	Event
+
+	// Argument is short description
+	Argument    string `json:"argument"`
+	Description string `json:"description"`
+	// ContentRating is age restriction like "16+"
+	ContentRating string      `json:"contentRating"`
+	Genres        []NamedItem `json:"genres"`
+	Trailers      []Trailer   `json:"trailers"`
+
+	// Duration in minutes
+	Duration     int        `json:"duration"`
+	Year         int        `json:"productionYear"`
+	DateReleased Date       `json:"dateReleased"`
+	Premieres    []Premiere `json:"premieres"`
 }
 
 // Only full color format is supported
@@ -30,26 +93,42 @@ const colorFormat = "#%02x%02x%02x"
 
 type Color color.RGBA
 
-// MarshalJSON conforms to json.Marshaler
+// IsZero reports whether color was not set
+func (c Color) IsZero() bool {
+	return c.A == 0
+}
+
+func (c Color) String() string {
+	return fmt.Sprintf(colorFormat, c.R, c.G, c.B)
+}
+
+// MarshalJSON conforms to json.Marshaler, unset color is null
 func (c Color) MarshalJSON() ([]byte, error) {
-	return json.Marshal(fmt.Sprintf(colorFormat, c.R, c.G, c.B))
+	if c.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(c.String())
 }
 
-// UnmarshalJSON conforms to json.Unmarshaler
+// UnmarshalJSON conforms to json.Unmarshaler, null and empty string are unset color
 func (c *Color) UnmarshalJSON(data []byte) error {
-	var strData string
+	var strData *string
 	err := json.Unmarshal(data, &strData)
 	if err != nil {
 		return err
 	}
+	if strData == nil || *strData == "" {
+		*c = Color{}
+		return nil
+	}
 
-	n, err := fmt.Sscanf(strData, colorFormat, &c.R, &c.G, &c.B)
+	n, err := fmt.Sscanf(*strData, colorFormat, &c.R, &c.G, &c.B)
 
 	if err == nil && n != 3 {
 		err = errors.Errorf("Expected to scan 3 items, but got %d instead", n)
 	}
 	if err != nil {
-		return errors.Wrapf(err, "While parsing %v as color", strData)
+		return errors.Wrapf(err, "While parsing %v as color", *strData)
 	}
 
 	c.A = 255
@@ -148,6 +227,20 @@ type Coordinates struct {
 	Latitude  float32 `json:"latitude"`
 }
 
+// ValidCoordinates checks if lat/lon are in range and aren't both zero,
+// which is what API returns when place location is unknown
+func ValidCoordinates(lat, lon float64) bool {
+	if lat == 0 && lon == 0 {
+		return false
+	}
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// Valid checks if coordinates are known and in range
+func (c Coordinates) Valid() bool {
+	return ValidCoordinates(float64(c.Latitude), float64(c.Longitude))
+}
+
 // Place is a speicific place (i.e. cinema) to which schedule is applied
 type Place struct {
 	ID          string      `json:"id"`
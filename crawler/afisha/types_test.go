@@ -0,0 +1,82 @@
+package afisha
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestValidCoordinates(t *testing.T) {
+	for _, c := range []struct {
+		lat, lon float64
+		want     bool
+	}{
+		{55.7520, 37.6175, true},
+		{-33.8688, 151.2093, true},
+		{90, 180, true},
+		{-90, -180, true},
+		// Afisha sends zeroes for unknown coordinates
+		{0, 0, false},
+		{0, 37.6175, true},
+		{90.5, 37.6175, false},
+		{-91, 37.6175, false},
+		{55.7520, 180.1, false},
+		{55.7520, -181, false},
+		{math.NaN(), 37.6175, false},
+	} {
+		if got := ValidCoordinates(c.lat, c.lon); got != c.want {
+			t.Errorf("ValidCoordinates(%v, %v) = %v, want %v", c.lat, c.lon, got, c.want)
+		}
+	}
+}
+
+func TestColorJSON(t *testing.T) {
+	type colors struct {
+		Logo Color `json:"logo"`
+		BG   Color `json:"bg"`
+	}
+
+	tests := []struct {
+		in   colors
+		want string
+	}{
+		{colors{}, `{"logo":null,"bg":null}`},
+		{colors{Logo: Color{R: 0xff, A: 255}}, `{"logo":"#ff0000","bg":null}`},
+		{colors{Logo: Color{A: 255}, BG: Color{R: 0x12, G: 0x34, B: 0x56, A: 255}}, `{"logo":"#000000","bg":"#123456"}`},
+	}
+
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("Marshal(%+v) = %s, want %s", tt.in, data, tt.want)
+		}
+
+		var out colors
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.in {
+			t.Errorf("Round trip of %+v = %+v", tt.in, out)
+		}
+	}
+}
+
+func TestColorUnmarshalUnset(t *testing.T) {
+	for _, data := range []string{`null`, `""`} {
+		c := Color{R: 1, A: 255}
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			t.Errorf("Unmarshal(%s) failed: %v", data, err)
+		}
+		if !c.IsZero() {
+			t.Errorf("Expected %s to be unset color, got %v", data, c)
+		}
+	}
+
+	var c Color
+	if err := json.Unmarshal([]byte(`"red"`), &c); err == nil {
+		t.Errorf("Expected error on invalid color")
+	}
+}
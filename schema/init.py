@@ -1,4 +1,5 @@
 import json
+import glob
 from collections import defaultdict
 import psycopg2
 import sys
@@ -33,6 +34,12 @@ cur = conn.cursor()
 with open('kino.sql') as f:
     cur.execute(f.read())
 
+# Apply migrations of databases initialized with older schema,
+# they do nothing on fresh ones
+for fn in sorted(glob.glob('migrations/*.sql')):
+    with open(fn) as f:
+        cur.execute(f.read())
+
 # Fill Timezones
 cur.execute('''
 INSERT INTO timezones (name, utc_offset)
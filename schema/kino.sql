@@ -38,6 +38,9 @@ create table if not exists cities
     -- city "id" (name) used by yandex afisha
     ya_name      varchar(30) unique,
 
+    -- yandex region id
+    geo_id       int,
+
     timezone_id  int     not null references timezones (timezone_id) on delete restrict
 );
 
@@ -78,12 +81,45 @@ create table if not exists movies
     -- minimum age
     age_restriction smallint,
 
+    -- description from yandex afisha
+    description     text,
+
     country_code    char(2) references countries (country_code) on delete set null
 );
 
 create index if not exists movies_rating_index
     on movies (rating desc, kp_rating desc);
 
+-- yandex afisha events of movies merged into another movie
+create table if not exists event_aliases
+(
+    ya_event_id char(24) not null
+        primary key,
+    movie_id    int      not null references movies (movie_id) on delete cascade
+);
+
+create index if not exists event_aliases_movie_index
+    on event_aliases (movie_id);
+
+create table if not exists movie_images
+(
+    movie_id   int         not null references movies (movie_id) on delete cascade,
+    -- image rendition name on yandex afisha, like source or eventCover
+    kind       varchar(32) not null,
+    url        varchar     not null,
+    width      smallint,
+    height     smallint,
+
+    -- file name in local image cache, if downloaded
+    local_path varchar,
+    -- sha256 of image content
+    sha256     char(64),
+    CONSTRAINT movie_images_pk PRIMARY KEY (movie_id, kind)
+);
+
+create index if not exists movie_images_url_index
+    on movie_images (url);
+
 create table if not exists genres
 (
     genre_id int     not null
@@ -95,6 +131,9 @@ create table if not exists genres
     kp_id    smallint
 );
 
+create unique index if not exists genres_name_index
+    on genres (name_ru);
+
 create table if not exists movie_genres
 (
     movie_id int references movies (movie_id) on delete cascade,
@@ -102,6 +141,46 @@ create table if not exists movie_genres
     CONSTRAINT movie_genres_pk PRIMARY KEY (movie_id, genre_id)
 );
 
+create table if not exists people
+(
+    person_id int     not null
+        generated always as identity
+        primary key,
+    -- full name as seen on yandex afisha
+    name      varchar not null unique
+);
+
+create table if not exists movie_people
+(
+    movie_id  int         not null references movies (movie_id) on delete cascade,
+    person_id int         not null references people (person_id) on delete cascade,
+    -- one of director, producer, composer, actor
+    role      varchar(16) not null,
+    -- position in credits for the role
+    ord       smallint    not null default 0,
+    CONSTRAINT movie_people_pk PRIMARY KEY (movie_id, person_id, role)
+);
+
+create index if not exists movie_people_person_index
+    on movie_people (person_id);
+
+create table if not exists movie_countries
+(
+    movie_id     int references movies (movie_id) on delete cascade,
+    country_code char(2) references countries (country_code) on delete cascade,
+    CONSTRAINT movie_countries_pk PRIMARY KEY (movie_id, country_code)
+);
+
+-- cinema chains, detected by crawler
+create table if not exists chains
+(
+    chain_id int     not null
+        generated always as identity
+        primary key,
+    -- chain name, like "Синема Парк"
+    name     varchar not null unique
+);
+
 create table if not exists cinemas
 (
     cinema_id int     not null
@@ -111,16 +190,84 @@ create table if not exists cinemas
     name      varchar not null,
     -- full address in russian
     address   varchar not null,
-    -- coordinates
-    loc       point   not null,
+    -- coordinates as (longitude, latitude), null if unknown
+    loc       point,
 
     -- the city
     city_id   int     not null references cities (city_id) on delete restrict,
 
     -- place id on yandex afisha
-    ya_id     char(24) unique
+    ya_id     char(24) unique,
+
+    -- branding colors, like #ff00ff
+    logo_color char(7),
+    bg_color   char(7),
+
+    -- cinema chain, if any
+    chain_id  int references chains (chain_id) on delete set null
+);
+
+create index if not exists cinemas_chain_index
+    on cinemas (chain_id);
+
+create table if not exists metro_stations
+(
+    station_id  int     not null
+        generated always as identity
+        primary key,
+
+    city_id     int     not null references cities (city_id) on delete cascade,
+
+    -- station name in russian
+    name        varchar not null,
+    -- metro line colors, like #ff00ff
+    colors      varchar[],
+
+    -- city_id and normalized station name, used by crawler to find stations
+    station_key varchar not null unique
 );
 
+create table if not exists cinema_metro
+(
+    cinema_id  int references cinemas (cinema_id) on delete cascade,
+    station_id int references metro_stations (station_id) on delete cascade,
+    CONSTRAINT cinema_metro_pk PRIMARY KEY (cinema_id, station_id)
+);
+
+create index if not exists cinema_metro_station_index
+    on cinema_metro (station_id);
+
+-- external links, i.e. official cinema site
+create table if not exists cinema_links
+(
+    cinema_id int references cinemas (cinema_id) on delete cascade,
+    url       varchar not null,
+    CONSTRAINT cinema_links_pk PRIMARY KEY (cinema_id, url)
+);
+
+create table if not exists halls
+(
+    hall_id    int     not null
+        generated always as identity
+        primary key,
+
+    cinema_id  int     not null references cinemas (cinema_id) on delete cascade,
+
+    -- hall name as seen on yandex afisha
+    name       varchar not null,
+
+    -- cinema_id and normalized hall name, used by crawler to find halls
+    hall_key   varchar not null unique,
+
+    -- supported session types, same as sessions.type
+    formats    int,
+    -- number of seats
+    seat_count smallint
+);
+
+create index if not exists halls_cinema_index
+    on halls (cinema_id);
+
 create table if not exists sessions
 (
     session_id int       not null
@@ -129,6 +276,7 @@ create table if not exists sessions
 
     -- cinema specific hall name
     hall_name  varchar,
+    hall_id    int references halls (hall_id) on delete set null,
 
     cinema_id  int       not null references cinemas (cinema_id) on delete cascade,
     movie_id   int       not null references movies (movie_id) on delete cascade,
@@ -154,6 +302,38 @@ create index if not exists sessions_city_movie_index
 create index if not exists sessions_cinema_index
     on sessions (cinema_id, date desc);
 
+create index if not exists sessions_hall_index
+    on sessions (hall_id, date desc);
+
+-- price observations, appended by crawler whenever session price changes
+create table if not exists session_prices
+(
+    session_id  int       not null references sessions (session_id) on delete cascade,
+
+    -- when the price was crawled
+    observed_at timestamp not null,
+
+    -- price range in rub
+    price_min   smallint,
+    price_max   smallint,
+    CONSTRAINT session_prices_pk PRIMARY KEY (session_id, observed_at)
+);
+
+-- session counts and prices aggregated per cinema chain
+create or replace view chain_stats as
+select ch.chain_id,
+       ch.name,
+       count(distinct c.cinema_id) as cinemas,
+       count(s.session_id)         as sessions,
+       avg(s.price_min)            as avg_price_min,
+       avg(s.price_max)            as avg_price_max,
+       min(s.price_min)            as price_min,
+       max(s.price_max)            as price_max
+from chains ch
+         join cinemas c on c.chain_id = ch.chain_id
+         left join sessions s on s.cinema_id = c.cinema_id
+group by ch.chain_id, ch.name;
+
 create table if not exists users
 (
     user_id       int         not null
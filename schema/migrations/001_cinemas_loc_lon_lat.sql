@@ -0,0 +1,26 @@
+-- cinemas.loc used to be point(latitude, longitude) and not null,
+-- with (0, 0) stored for unknown coordinates.
+-- Now it's point(longitude, latitude) and null if unknown.
+--
+-- Migration only runs while loc is still not null, so it's safe to apply again.
+-- Apply it before filling with new crawler, otherwise new rows are swapped too:
+--   psql -v ON_ERROR_STOP=1 -1 -f migrations/001_cinemas_loc_lon_lat.sql kino
+do
+$$
+    begin
+        if exists(select 1
+                  from pg_attribute
+                  where attrelid = 'cinemas'::regclass
+                    and attname = 'loc'
+                    and attnotnull) then
+            alter table cinemas
+                alter column loc drop not null;
+
+            update cinemas
+            set loc = case
+                          when loc[0] = 0 and loc[1] = 0 then null
+                          else point(loc[1], loc[0])
+                end;
+        end if;
+    end
+$$;